@@ -0,0 +1,11 @@
+package api
+
+import (
+	_ "embed"
+)
+
+// OpenAPI describes the REST/JSON gateway, generated by protoc-gen-openapiv2
+// from the google.api.http options of api.proto
+//
+//go:embed api.swagger.json
+var OpenAPI []byte
@@ -2,9 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
 	"log"
 	"os"
 	"time"
@@ -14,10 +33,43 @@ import (
 
 var server_address string
 var fetch_url string
+var force_fetch bool
+var credential string
+var request_id string
+var otlp_endpoint string
+var otlp_insecure bool
+var fetch_retries int
+var list_source string
+var tenant string
+var api_key string
+var bearer_token string
+var use_tls bool
+var tls_ca string
+var tls_cert string
+var tls_key string
+var tls_server_name string
+var subscribe_cron string
+var subscribe_interval int64
+var list_subscriptions bool
+var watch_changes bool
+var webhook_url string
+var list_webhooks bool
+var product_pattern string
+var min_change float64
+var min_change_percent float64
 var show_help bool
+var fetch_timeout time.Duration
+var call_timeout time.Duration
+
+// finish_trace ends the span of this run and sends it. errorCheck calls it
+// too, log.Fatal skips deferred calls and a failed run is the one to trace.
+var finish_trace = func(err error) {}
 
 const DEFAULT_SERVER_ADDRESS = "localhost:55555"
 const DEFAULT_FETCH_URL = "http://localhost:3000/products.csv"
+const DEFAULT_FETCH_RETRIES = 3
+const DEFAULT_FETCH_TIMEOUT = 10 * time.Minute
+const DEFAULT_TIMEOUT = 10 * time.Second
 
 func main() {
 	systemParams()
@@ -27,7 +79,29 @@ func main() {
 		os.Exit(1)
 	}
 
-	conn, err := grpc.Dial(server_address, grpc.WithInsecure(), grpc.WithBlock())
+	provider := tracerProvider()
+
+	// every call of this run belongs to one trace, continued by the server
+	trace_context, span := provider.Tracer("github.com/ksukhorukov/atlant/client").Start(context.Background(), "atlant-client")
+
+	finish_trace = func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+
+		span.End()
+
+		flush_context, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+
+		defer cancel()
+
+		provider.Shutdown(flush_context)
+	}
+
+	defer finish_trace(nil)
+
+	conn, err := grpc.Dial(server_address, transportOption(), grpc.WithBlock(), grpc.WithChainUnaryInterceptor(withMetadata), grpc.WithChainStreamInterceptor(withStreamMetadata), grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithTracerProvider(provider))))
 
 	errorCheck(err)
 
@@ -35,20 +109,108 @@ func main() {
 
 	c := api.NewApiClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(trace_context, call_timeout)
 	defer cancel()
 
-	fetch_request, fetch_err := c.Fetch(ctx, &api.FetchRequest{Url: fetch_url})
+	if subscribe_cron != "" || subscribe_interval != 0 {
+		subscription, err := c.CreateSubscription(ctx, &api.Subscription{
+			Url:        fetch_url,
+			Cron:       subscribe_cron,
+			Interval:   subscribe_interval,
+			Credential: credential,
+			Force:      force_fetch,
+		})
+
+		errorCheck(err)
+
+		printSubscription(subscription)
+
+		return
+	}
+
+	if list_subscriptions {
+		subscriptions, err := c.ListSubscriptions(ctx, &api.ListSubscriptionsRequest{})
+
+		errorCheck(err)
+
+		for _, subscription := range subscriptions.GetSubscriptions() {
+			printSubscription(subscription)
+		}
+
+		return
+	}
+
+	if webhook_url != "" {
+		webhook, err := c.CreateWebhook(ctx, &api.Webhook{Url: webhook_url})
+
+		errorCheck(err)
+
+		// the secret is not shown again
+		log.Printf("Webhook: %s, URL: %s, Secret: %s\n", webhook.GetId(), webhook.GetUrl(), webhook.GetSecret())
+
+		return
+	}
+
+	if list_webhooks {
+		webhooks, err := c.ListWebhooks(ctx, &api.ListWebhooksRequest{})
+
+		errorCheck(err)
+
+		for _, webhook := range webhooks.GetWebhooks() {
+			dead_letters, err := c.ListDeadLetters(ctx, &api.ListDeadLettersRequest{WebhookId: webhook.GetId()})
+
+			errorCheck(err)
+
+			log.Printf("Webhook: %s, URL: %s, Last delivery: %v, Last error: %q, Dead letters: %d\n",
+				webhook.GetId(),
+				webhook.GetUrl(),
+				webhook.GetLastDelivery().AsTime(),
+				webhook.GetLastError(),
+				len(dead_letters.GetDeadLetters()))
+		}
+
+		return
+	}
+
+	if watch_changes {
+		watch(trace_context, c, &api.WatchPriceChangesRequest{
+			ProductPattern:   product_pattern,
+			MinChange:        min_change,
+			MinChangePercent: min_change_percent,
+			Source:           list_source,
+		})
+
+		return
+	}
+
+	if request_id == "" {
+		request_id = newRequestId()
+	}
+
+	fetch_request, fetch_err := fetch(trace_context, c, &api.FetchRequest{
+		Url:        fetch_url,
+		Force:      force_fetch,
+		Credential: credential,
+		RequestId:  request_id,
+	})
 
 	errorCheck(fetch_err)
 
-	log.Printf("Imported: %d", fetch_request.GetCount())
+	if fetch_request.GetNotModified() {
+		log.Printf("Not modified since the last import")
+	} else {
+		log.Printf("Imported: %d, Import id: %s", fetch_request.GetCount(), fetch_request.GetImportId())
+	}
+
+	list_context, list_cancel := context.WithTimeout(trace_context, call_timeout)
+	defer list_cancel()
 
-	list_request, list_err := c.List(ctx, &api.ListRequest{
+	list_request, list_err := c.List(list_context, &api.ListRequest{
 		Column:         "price",
-		Order:          1, //ascending, -1 means descending
+		Order:          api.SortOrder_SORT_ORDER_ASC,
 		PageNumber:     1,
 		ResultsPerPage: 50,
+		Source:         list_source,
 	})
 
 	errorCheck(list_err)
@@ -58,16 +220,207 @@ func main() {
 	for i := 0; i < len(results); i++ {
 		record := results[i]
 
-		log.Printf("Product: %s, Price: %f, Times price changed: %d, Request time: %v\n",
+		log.Printf("Product: %s, Price: %f, Times price changed: %d, Request time: %v, Source: %s, Import id: %s\n",
 			record.GetProduct(),
 			record.GetPrice(),
 			record.GetTimespricechanged(),
-			time.Unix(record.GetRequesttime(), 0))
+			record.GetRequesttime().AsTime(),
+			record.GetSource(),
+			record.GetImportId())
+	}
+}
+
+// fetch retries timed out or interrupted imports with the same request id,
+// the server replays the recorded response instead of importing twice
+func fetch(parent context.Context, c api.ApiClient, in *api.FetchRequest) (*api.FetchResponse, error) {
+	for attempt := 0; ; attempt++ {
+		// the server stops importing when we stop waiting
+		ctx, cancel := context.WithTimeout(parent, fetch_timeout)
+
+		response, err := c.Fetch(ctx, in)
+
+		cancel()
+
+		if err == nil || attempt >= fetch_retries {
+			return response, err
+		}
+
+		switch status.Code(err) {
+		case codes.DeadlineExceeded, codes.Unavailable, codes.Aborted, codes.ResourceExhausted:
+			delay := retryDelay(err, time.Duration(attempt+1)*time.Second)
+
+			log.Printf("Retrying request %s in %v: %v", in.GetRequestId(), delay, err)
+
+			time.Sleep(delay)
+		default:
+			return response, err
+		}
+	}
+}
+
+// watch logs the price changes the server streams until interrupted
+func watch(ctx context.Context, c api.ApiClient, in *api.WatchPriceChangesRequest) {
+	stream, err := c.WatchPriceChanges(ctx, in)
+
+	errorCheck(err)
+
+	for {
+		change, err := stream.Recv()
+
+		errorCheck(err)
+
+		log.Printf("Product: %s, Old price: %f, New price: %f, Added: %v, Source: %s, Import id: %s, Time: %v\n",
+			change.GetProduct(),
+			change.GetOldPrice(),
+			change.GetNewPrice(),
+			change.GetAdded(),
+			change.GetSource(),
+			change.GetImportId(),
+			change.GetTime().AsTime())
+	}
+}
+
+// withMetadata sends --tenant and the credentials with every call, the
+// server keeps a separate catalogue per tenant. Each call also gets its own
+// x-request-id, logged here and in the server logs alike.
+func withMetadata(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, call_id := outgoingMetadata(ctx)
+
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	log.Printf("Call %s, x-request-id %s, trace id %s: %v", method, call_id, trace.SpanContextFromContext(ctx).TraceID(), status.Code(err))
+
+	return err
+}
+
+// withStreamMetadata does the same for streams, logging when they start
+func withStreamMetadata(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, call_id := outgoingMetadata(ctx)
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+
+	log.Printf("Stream %s, x-request-id %s, trace id %s: %v", method, call_id, trace.SpanContextFromContext(ctx).TraceID(), status.Code(err))
+
+	return stream, err
+}
+
+func outgoingMetadata(ctx context.Context) (context.Context, string) {
+	call_id := newRequestId()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", call_id)
+
+	if tenant != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "atlant-tenant", tenant)
+	}
+
+	if api_key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", api_key)
+	}
+
+	if bearer_token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+bearer_token)
+	}
+
+	return ctx, call_id
+}
+
+// transportOption uses TLS when any of the TLS flags is given. --tls_ca
+// replaces the system roots, --tls_cert and --tls_key authenticate the
+// client to servers requiring mutual TLS.
+func transportOption() grpc.DialOption {
+	if !use_tls && tls_ca == "" && tls_cert == "" && tls_server_name == "" {
+		return grpc.WithInsecure()
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: tls_server_name}
+
+	if tls_ca != "" {
+		pem, err := ioutil.ReadFile(tls_ca)
+
+		errorCheck(err)
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			errorCheck(fmt.Errorf("Cannot parse CA certificates: %s", tls_ca))
+		}
+	}
+
+	if tls_cert != "" || tls_key != "" {
+		certificate, err := tls.LoadX509KeyPair(tls_cert, tls_key)
+
+		errorCheck(err)
+
+		config.Certificates = []tls.Certificate{certificate}
 	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
+// tracerProvider samples every call so that its trace context reaches the
+// server, spans are exported only when --otlp_endpoint is set
+func tracerProvider() *sdktrace.TracerProvider {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "atlant-client"))),
+	}
+
+	if otlp_endpoint != "" {
+		exporter_options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(otlp_endpoint)}
+
+		if otlp_insecure {
+			exporter_options = append(exporter_options, otlptracegrpc.WithInsecure())
+		}
+
+		exporter, err := otlptracegrpc.New(context.Background(), exporter_options...)
+
+		errorCheck(err)
+
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(options...)
+}
+
+// retryDelay is the delay the server asked for, or fallback
+func retryDelay(err error, fallback time.Duration) time.Duration {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration()
+		}
+	}
+
+	return fallback
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+
+	errorCheck(err)
+
+	return hex.EncodeToString(id)
+}
+
+func printSubscription(subscription *api.Subscription) {
+	log.Printf("Subscription: %s, URL: %s, Cron: %q, Interval: %ds, Next run: %v, Last run: %v, Last count: %d, Last error: %q\n",
+		subscription.GetId(),
+		subscription.GetUrl(),
+		subscription.GetCron(),
+		subscription.GetInterval(),
+		subscription.GetNextRun().AsTime(),
+		subscription.GetLastRun().AsTime(),
+		subscription.GetLastCount(),
+		subscription.GetLastError())
 }
 
 func errorCheck(err error) {
 	if err != nil {
+		finish_trace(err)
+
 		log.Fatal(err)
 	}
 }
@@ -75,11 +428,52 @@ func errorCheck(err error) {
 func systemParams() {
 	flag.StringVar(&server_address, "server", DEFAULT_SERVER_ADDRESS, "Address of our server")
 	flag.StringVar(&fetch_url, "url", DEFAULT_FETCH_URL, "CSV file URL")
+	flag.BoolVar(&use_tls, "tls", false, "Connect over TLS verified with the system roots")
+	flag.StringVar(&tls_ca, "tls_ca", "", "PEM CA certificates to verify the server with, implies --tls")
+	flag.StringVar(&tls_cert, "tls_cert", "", "PEM client certificate for mutual TLS, implies --tls")
+	flag.StringVar(&tls_key, "tls_key", "", "PEM private key of the client certificate")
+	flag.StringVar(&tls_server_name, "tls_server_name", "", "Name to verify the server certificate against, the host of --server if empty")
+	flag.StringVar(&tenant, "tenant", "", "Catalogue to work with, the default one if empty")
+	flag.StringVar(&api_key, "api_key", "", "API key, $ATLANT_API_KEY by default")
+	flag.StringVar(&bearer_token, "token", "", "JWT bearer token, $ATLANT_TOKEN by default")
+	flag.BoolVar(&force_fetch, "force", false, "Import the file even if it has not changed")
+	flag.StringVar(&credential, "credential", "", "Name of a server side credential to download the file with")
+	flag.StringVar(&request_id, "request_id", "", "Idempotency key of the fetch, random if empty")
+	flag.DurationVar(&fetch_timeout, "fetch_timeout", DEFAULT_FETCH_TIMEOUT, "How long to wait for an import, download included")
+	flag.DurationVar(&call_timeout, "timeout", DEFAULT_TIMEOUT, "How long to wait for the other calls")
+	flag.IntVar(&fetch_retries, "retries", DEFAULT_FETCH_RETRIES, "Number of fetch retries with the same request id")
+	flag.StringVar(&list_source, "source", "", "List only products whose price was last set by this feed URL")
+	flag.StringVar(&subscribe_cron, "cron", "", "Subscribe to the URL on this cron schedule instead of fetching it once")
+	flag.Int64Var(&subscribe_interval, "interval", 0, "Subscribe to the URL with this interval in seconds instead of fetching it once")
+	flag.BoolVar(&list_subscriptions, "subscriptions", false, "List subscriptions")
+	flag.StringVar(&webhook_url, "webhook", "", "Create a webhook receiving the price changes of every import at this URL")
+	flag.BoolVar(&list_webhooks, "webhooks", false, "List webhooks with their dead letter counts")
+	flag.BoolVar(&watch_changes, "watch", false, "Log price changes as imports make them until interrupted")
+	flag.StringVar(&product_pattern, "product_pattern", "", "With --watch, only products matching this regular expression")
+	flag.Float64Var(&min_change, "min_change", 0, "With --watch, only price changes of at least this much")
+	flag.Float64Var(&min_change_percent, "min_change_percent", 0, "With --watch, only price changes of at least this percentage")
+	flag.StringVar(&otlp_endpoint, "otlp_endpoint", "", "host:port of an OTLP/gRPC collector to send the client spans to")
+	flag.BoolVar(&otlp_insecure, "otlp_insecure", false, "Connect to the OTLP collector without TLS")
 	flag.BoolVar(&show_help, "help", false, "Help center")
 	flag.Parse()
+
+	// read here rather than as flag defaults, which --help would print
+	if api_key == "" {
+		api_key = os.Getenv("ATLANT_API_KEY")
+	}
+
+	if bearer_token == "" {
+		bearer_token = os.Getenv("ATLANT_TOKEN")
+	}
 }
 
 func usage() {
 	fmt.Printf("Usage:\n\n")
 	fmt.Printf("%s --server=localhost:5555 --url=http://localhost:3000/products.csv\n\n", os.Args[0])
+	fmt.Printf("%s --server=atlant.example.com:5555 --tls_ca=ca.pem --tls_cert=client.pem --tls_key=client.key --tenant=shop --url=https://example.com/products.csv\n\n", os.Args[0])
+	fmt.Printf("%s --api_key=secret --request_id=import-2024-01-01 --retries=5 --url=https://example.com/products.csv\n\n", os.Args[0])
+	fmt.Printf("Options:\n\n")
+
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.PrintDefaults()
 }
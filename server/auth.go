@@ -0,0 +1,568 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	API_KEY_METADATA_KEY       = "x-api-key"
+	AUTHORIZATION_METADATA_KEY = "authorization"
+
+	ROLE_READER = "reader"
+	ROLE_WRITER = "writer"
+	ROLE_ADMIN  = "admin"
+
+	// REFLECTION_PREFIX covers both versions of the reflection service
+	REFLECTION_PREFIX         = "/grpc.reflection."
+	REFLECTION_METHOD         = REFLECTION_PREFIX + "v1.ServerReflection/ServerReflectionInfo"
+	REFLECTION_V1ALPHA_METHOD = REFLECTION_PREFIX + "v1alpha.ServerReflection/ServerReflectionInfo"
+
+	JWT_LEEWAY = time.Minute
+
+	ERROR_UNAUTHENTICATED  = "Missing API key or bearer token"
+	ERROR_INVALID_API_KEY  = "Invalid API key"
+	ERROR_INVALID_TOKEN    = "Invalid bearer token"
+	ERROR_UNKNOWN_JWK      = "Token is signed with an unknown key"
+	ERROR_TOKEN_EXPIRY     = "Token has no expiry"
+	ERROR_METHOD_FORBIDDEN = "Not allowed to call"
+	ERROR_TENANT_FORBIDDEN = "Not allowed to use tenant"
+	ERROR_API_KEY_EMPTY    = "API key must not be empty"
+	ERROR_API_KEY_ROLES    = "API key must have at least one role"
+	ERROR_UNKNOWN_CERT     = "Client certificate is not mapped to roles"
+	ERROR_CERT_ROLES       = "Client certificate must have at least one role"
+)
+
+var api_keys_file = ""
+var jwks_file = ""
+var jwt_issuer = ""
+var jwt_audience = ""
+var auth_rules_file = ""
+var client_certs_file = ""
+
+var authenticator *Authenticator
+
+// Identity is an authenticated caller. Tenants limits the catalogues it may
+// use, empty means any.
+type Identity struct {
+	Name    string
+	Method  string
+	Roles   []string
+	Tenants []string
+}
+
+// APIKey is an entry of the --api_keys file, keyed by the caller name. Key
+// may refer to environment variables as $NAME or ${NAME}.
+type APIKey struct {
+	Key     string   `json:"key"`
+	Roles   []string `json:"roles"`
+	Tenants []string `json:"tenants"`
+}
+
+// CertSubject is an entry of the --client_certs file, keyed by the common
+// name or a DNS or URI SAN of verified client certificates.
+type CertSubject struct {
+	Roles   []string `json:"roles"`
+	Tenants []string `json:"tenants"`
+}
+
+// AuthConfig names the files an Authenticator is built from
+type AuthConfig struct {
+	APIKeys     string
+	JWKS        string
+	ClientCerts string
+	Rules       string
+	Issuer      string
+	Audience    string
+}
+
+// TokenClaims are the claims we read from a JWT besides the registered ones
+type TokenClaims struct {
+	jwt.Claims
+
+	Roles   []string `json:"roles"`
+	Tenants []string `json:"tenants"`
+}
+
+// Authenticator checks API keys and JWTs and the roles a method requires
+type Authenticator struct {
+	Keys     map[string]*Identity
+	Certs    map[string]*Identity
+	JWKS     *jose.JSONWebKeySet
+	Issuer   string
+	Audience string
+	Rules    map[string][]string
+}
+
+type identityKey struct{}
+
+// DefaultRules lets readers list, watch and use reflection, writers also
+// fetch and admins manage subscriptions and webhooks. Methods without a
+// rule are denied.
+func DefaultRules() map[string][]string {
+	read := []string{ROLE_READER, ROLE_WRITER, ROLE_ADMIN}
+	write := []string{ROLE_WRITER, ROLE_ADMIN}
+	admin := []string{ROLE_ADMIN}
+
+	return map[string][]string{
+		MethodName("List"):               read,
+		MethodName("ListSubscriptions"):  read,
+		MethodName("WatchPriceChanges"):  read,
+		MethodName("ListWebhooks"):       read,
+		MethodName("ListDeadLetters"):    read,
+		MethodName("Fetch"):              write,
+		MethodName("CreateSubscription"): admin,
+		MethodName("UpdateSubscription"): admin,
+		MethodName("DeleteSubscription"): admin,
+		MethodName("CreateWebhook"):      admin,
+		MethodName("DeleteWebhook"):      admin,
+		REFLECTION_METHOD:                read,
+		REFLECTION_V1ALPHA_METHOD:        read,
+	}
+}
+
+// PublicMethod tells whether a method is open to everybody, load balancers
+// check health without credentials and so may tools using reflection when
+// public_reflection is set
+func PublicMethod(method string) bool {
+	if strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return true
+	}
+
+	return public_reflection && strings.HasPrefix(method, REFLECTION_PREFIX)
+}
+
+// MethodName turns a method of our service into its full gRPC name
+func MethodName(method string) string {
+	if strings.HasPrefix(method, "/") {
+		return method
+	}
+
+	return "/" + api.Api_ServiceDesc.ServiceName + "/" + method
+}
+
+// NewAuthenticator loads the configured files, it returns nil when no API
+// keys, JWKS or client certificates are given and the server stays open.
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if config.APIKeys == "" && config.JWKS == "" && config.ClientCerts == "" {
+		return nil, nil
+	}
+
+	auth := &Authenticator{
+		Keys:     map[string]*Identity{},
+		Certs:    map[string]*Identity{},
+		Issuer:   config.Issuer,
+		Audience: config.Audience,
+		Rules:    DefaultRules(),
+	}
+
+	if config.APIKeys != "" {
+		keys, err := LoadAPIKeys(config.APIKeys)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.APIKeys, err)
+		}
+
+		auth.Keys = keys
+	}
+
+	if config.JWKS != "" {
+		jwks, err := LoadJWKS(config.JWKS)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.JWKS, err)
+		}
+
+		auth.JWKS = jwks
+	}
+
+	if config.ClientCerts != "" {
+		certs, err := LoadCertSubjects(config.ClientCerts)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.ClientCerts, err)
+		}
+
+		auth.Certs = certs
+	}
+
+	if config.Rules != "" {
+		data, err := ioutil.ReadFile(config.Rules)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var rules map[string][]string
+
+		err = json.Unmarshal(data, &rules)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.Rules, err)
+		}
+
+		for method, roles := range rules {
+			auth.Rules[MethodName(method)] = roles
+		}
+	}
+
+	return auth, nil
+}
+
+// LoadAPIKeys returns identities indexed by the SHA-256 of their key
+func LoadAPIKeys(file_path string) (map[string]*Identity, error) {
+	data, err := ioutil.ReadFile(file_path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]*APIKey
+
+	err = json.Unmarshal(data, &keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	identities := map[string]*Identity{}
+
+	for name, key := range keys {
+		secret := os.ExpandEnv(key.Key)
+
+		if secret == "" {
+			return nil, fmt.Errorf("%s: %s", name, ERROR_API_KEY_EMPTY)
+		}
+
+		if len(key.Roles) == 0 {
+			return nil, fmt.Errorf("%s: %s", name, ERROR_API_KEY_ROLES)
+		}
+
+		identities[KeyHash(secret)] = &Identity{
+			Name:    name,
+			Method:  "api_key",
+			Roles:   key.Roles,
+			Tenants: key.Tenants,
+		}
+	}
+
+	return identities, nil
+}
+
+// LoadCertSubjects returns identities indexed by certificate subject name
+func LoadCertSubjects(file_path string) (map[string]*Identity, error) {
+	data, err := ioutil.ReadFile(file_path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var subjects map[string]*CertSubject
+
+	err = json.Unmarshal(data, &subjects)
+
+	if err != nil {
+		return nil, err
+	}
+
+	identities := map[string]*Identity{}
+
+	for name, subject := range subjects {
+		if len(subject.Roles) == 0 {
+			return nil, fmt.Errorf("%s: %s", name, ERROR_CERT_ROLES)
+		}
+
+		identities[name] = &Identity{
+			Name:    name,
+			Method:  "tls",
+			Roles:   subject.Roles,
+			Tenants: subject.Tenants,
+		}
+	}
+
+	return identities, nil
+}
+
+func LoadJWKS(file_path string) (*jose.JSONWebKeySet, error) {
+	data, err := ioutil.ReadFile(file_path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks jose.JSONWebKeySet
+
+	err = json.Unmarshal(data, &jwks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwks, nil
+}
+
+func KeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate finds out who is calling from the request metadata
+func (a *Authenticator) Authenticate(ctx context.Context) (*Identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if keys := md.Get(API_KEY_METADATA_KEY); len(keys) > 0 {
+		identity, ok := a.Keys[KeyHash(keys[0])]
+
+		if !ok {
+			return nil, status.Errorf(codes.Unauthenticated, "%s", ERROR_INVALID_API_KEY)
+		}
+
+		return identity, nil
+	}
+
+	if values := md.Get(AUTHORIZATION_METADATA_KEY); len(values) > 0 && a.JWKS != nil {
+		token := strings.TrimSpace(strings.TrimPrefix(values[0], "Bearer "))
+
+		identity, err := a.VerifyToken(token, time.Now())
+
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "%s: %v", ERROR_INVALID_TOKEN, err)
+		}
+
+		return identity, nil
+	}
+
+	if certificate := ClientCertificate(ctx); certificate != nil {
+		for _, name := range CertificateNames(certificate) {
+			if identity, ok := a.Certs[name]; ok {
+				return identity, nil
+			}
+		}
+
+		return nil, status.Errorf(codes.Unauthenticated, "%s: %s", ERROR_UNKNOWN_CERT, certificate.Subject.CommonName)
+	}
+
+	return nil, status.Errorf(codes.Unauthenticated, "%s", ERROR_UNAUTHENTICATED)
+}
+
+// ClientCertificate returns the verified certificate the caller presented
+// over mutual TLS, to us or to the gateway, or nil
+func ClientCertificate(ctx context.Context) *x509.Certificate {
+	if certificate := GatewayCertificate(ctx); certificate != nil {
+		return certificate
+	}
+
+	caller, ok := peer.FromContext(ctx)
+
+	if !ok {
+		return nil
+	}
+
+	info, ok := caller.AuthInfo.(credentials.TLSInfo)
+
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return info.State.VerifiedChains[0][0]
+}
+
+// CertificateNames lists the names a certificate may be mapped by
+func CertificateNames(certificate *x509.Certificate) []string {
+	var names []string
+
+	if certificate.Subject.CommonName != "" {
+		names = append(names, certificate.Subject.CommonName)
+	}
+
+	names = append(names, certificate.DNSNames...)
+
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// VerifyToken checks the signature of a JWT against the JWKS as well as its
+// expiry, issuer and audience
+func (a *Authenticator) VerifyToken(token string, now time.Time) (*Identity, error) {
+	parsed, err := jwt.ParseSigned(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parsed.Headers) != 1 {
+		return nil, fmt.Errorf("%s", ERROR_UNKNOWN_JWK)
+	}
+
+	header := parsed.Headers[0]
+
+	var keys []jose.JSONWebKey
+
+	if header.KeyID != "" {
+		keys = a.JWKS.Key(header.KeyID)
+	} else if len(a.JWKS.Keys) == 1 {
+		keys = a.JWKS.Keys
+	}
+
+	if len(keys) == 0 || (keys[0].Algorithm != "" && keys[0].Algorithm != header.Algorithm) {
+		return nil, fmt.Errorf("%s", ERROR_UNKNOWN_JWK)
+	}
+
+	var claims TokenClaims
+
+	err = parsed.Claims(keys[0].Key, &claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("%s", ERROR_TOKEN_EXPIRY)
+	}
+
+	expected := jwt.Expected{Issuer: a.Issuer, Time: now}
+
+	if a.Audience != "" {
+		expected.Audience = jwt.Audience{a.Audience}
+	}
+
+	err = claims.ValidateWithLeeway(expected, JWT_LEEWAY)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Name:    claims.Subject,
+		Method:  "jwt",
+		Roles:   claims.Roles,
+		Tenants: claims.Tenants,
+	}, nil
+}
+
+// Authorize checks the roles the method requires and the tenant
+func (a *Authenticator) Authorize(identity *Identity, method string, tenant string) error {
+	if !identity.HasAnyRole(a.Rules[method]) {
+		return status.Errorf(codes.PermissionDenied, "%s %s", ERROR_METHOD_FORBIDDEN, method)
+	}
+
+	if !identity.AllowsTenant(tenant) {
+		return status.Errorf(codes.PermissionDenied, "%s %q", ERROR_TENANT_FORBIDDEN, tenant)
+	}
+
+	return nil
+}
+
+func (a *Authenticator) Check(ctx context.Context, method string) (context.Context, error) {
+	identity, err := a.Authenticate(ctx)
+
+	if err != nil {
+		return ctx, err
+	}
+
+	tenant, err := IncomingTenant(ctx)
+
+	if err != nil {
+		return ctx, err
+	}
+
+	err = a.Authorize(identity, method, tenant)
+
+	if err != nil {
+		return ctx, err
+	}
+
+	return WithIdentity(ctx, identity), nil
+}
+
+func (i *Identity) HasAnyRole(roles []string) bool {
+	for _, role := range roles {
+		for _, own := range i.Roles {
+			if role == own {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (i *Identity) AllowsTenant(tenant string) bool {
+	if len(i.Tenants) == 0 {
+		return true
+	}
+
+	for _, allowed := range i.Tenants {
+		if allowed == tenant {
+			return true
+		}
+	}
+
+	return false
+}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the caller, nil when authentication is off
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+
+	return identity
+}
+
+// AuthUnaryInterceptor rejects unary calls the caller may not make
+func AuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if authenticator == nil || PublicMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+
+	ctx, err := authenticator.Check(ctx, info.FullMethod)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// AuthStreamInterceptor does the same for streaming calls
+func AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if authenticator == nil || PublicMethod(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	ctx, err := authenticator.Check(ss.Context(), info.FullMethod)
+
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &contextStream{ss, ctx})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeJSON(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	require.NoError(t, err)
+
+	file_path := filepath.Join(t.TempDir(), "auth.json")
+
+	require.NoError(t, ioutil.WriteFile(file_path, data, 0600))
+
+	return file_path
+}
+
+func signToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims TokenClaims) string {
+	options := (&jose.SignerOptions{}).WithHeader("kid", kid)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, options)
+	require.NoError(t, err)
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+
+	return token
+}
+
+func incoming(pairs ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+}
+
+func TestAPIKeyAuthorization(t *testing.T) {
+	os.Setenv("ATLANT_TEST_WRITER_KEY", "writer-secret")
+
+	defer os.Unsetenv("ATLANT_TEST_WRITER_KEY")
+
+	keys := writeJSON(t, map[string]*APIKey{
+		"dashboard": {Key: "reader-secret", Roles: []string{ROLE_READER}},
+		"importer":  {Key: "${ATLANT_TEST_WRITER_KEY}", Roles: []string{ROLE_WRITER}, Tenants: []string{"retail"}},
+	})
+
+	auth, err := NewAuthenticator(AuthConfig{APIKeys: keys})
+
+	require.NoError(t, err)
+
+	ctx, err := auth.Check(incoming(API_KEY_METADATA_KEY, "reader-secret"), MethodName("List"))
+
+	require.NoError(t, err)
+	require.Equal(t, "dashboard", IdentityFromContext(ctx).Name)
+
+	// read-only callers may not import
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "reader-secret"), MethodName("Fetch"))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "writer-secret", TENANT_METADATA_KEY, "retail"), MethodName("Fetch"))
+
+	require.NoError(t, err)
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "writer-secret", TENANT_METADATA_KEY, "wholesale"), MethodName("Fetch"))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "writer-secret"), MethodName("CreateSubscription"))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "guess"), MethodName("List"))
+
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = auth.Check(incoming(), MethodName("List"))
+
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "reader-secret"), "/unknown.Service/Method")
+
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAPIKeysValidation(t *testing.T) {
+	_, err := NewAuthenticator(AuthConfig{APIKeys: writeJSON(t, map[string]*APIKey{"empty": {Key: "$ATLANT_TEST_UNSET", Roles: []string{ROLE_READER}}})})
+
+	require.Error(t, err)
+
+	_, err = NewAuthenticator(AuthConfig{APIKeys: writeJSON(t, map[string]*APIKey{"roleless": {Key: "secret"}})})
+
+	require.Error(t, err)
+
+	auth, err := NewAuthenticator(AuthConfig{})
+
+	require.NoError(t, err)
+	require.Nil(t, auth)
+}
+
+func TestJWTAuthorization(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := writeJSON(t, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"},
+	}})
+
+	auth, err := NewAuthenticator(AuthConfig{JWKS: jwks, Issuer: "https://auth.example.com", Audience: "atlant"})
+
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	valid := TokenClaims{
+		Claims: jwt.Claims{
+			Subject:  "pricing-team",
+			Issuer:   "https://auth.example.com",
+			Audience: jwt.Audience{"atlant"},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		Roles: []string{ROLE_READER},
+	}
+
+	bearer := func(token string) context.Context {
+		return incoming(AUTHORIZATION_METADATA_KEY, "Bearer "+token)
+	}
+
+	ctx, err := auth.Check(bearer(signToken(t, key, "k1", valid)), MethodName("List"))
+
+	require.NoError(t, err)
+	require.Equal(t, "pricing-team", IdentityFromContext(ctx).Name)
+
+	_, err = auth.Check(bearer(signToken(t, key, "k1", valid)), MethodName("Fetch"))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+
+	no_expiry := valid
+	no_expiry.Expiry = nil
+
+	wrong_audience := valid
+	wrong_audience.Audience = jwt.Audience{"someone-else"}
+
+	wrong_issuer := valid
+	wrong_issuer.Issuer = "https://evil.example.com"
+
+	for _, token := range []string{
+		signToken(t, key, "k1", expired),
+		signToken(t, key, "k1", no_expiry),
+		signToken(t, key, "k1", wrong_audience),
+		signToken(t, key, "k1", wrong_issuer),
+		signToken(t, other, "k1", valid),
+		signToken(t, key, "k2", valid),
+		"not.a.token",
+	} {
+		_, err = auth.Check(bearer(token), MethodName("List"))
+
+		require.Equal(t, codes.Unauthenticated, status.Code(err), token)
+	}
+}
+
+func TestAuthRulesOverride(t *testing.T) {
+	keys := writeJSON(t, map[string]*APIKey{"importer": {Key: "writer-secret", Roles: []string{ROLE_WRITER}}})
+	rules := writeJSON(t, map[string][]string{"CreateSubscription": {ROLE_WRITER, ROLE_ADMIN}})
+
+	auth, err := NewAuthenticator(AuthConfig{APIKeys: keys, Rules: rules})
+
+	require.NoError(t, err)
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "writer-secret"), MethodName("CreateSubscription"))
+
+	require.NoError(t, err)
+
+	_, err = auth.Check(incoming(API_KEY_METADATA_KEY, "writer-secret"), MethodName("DeleteSubscription"))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestReflectionAuthorization(t *testing.T) {
+	keys := writeJSON(t, map[string]*APIKey{
+		"dashboard": {Key: "reader-secret", Roles: []string{ROLE_READER}},
+	})
+
+	auth, err := NewAuthenticator(AuthConfig{APIKeys: keys})
+
+	require.NoError(t, err)
+
+	authenticator = auth
+
+	defer func() { authenticator = nil }()
+
+	listener := bufconn.Listen(1 << 20)
+
+	s := grpc.NewServer(grpc.ChainStreamInterceptor(AuthStreamInterceptor))
+
+	api.RegisterApiServer(s, &api.UnimplementedApiServer{})
+	reflection.Register(s)
+
+	go s.Serve(listener)
+
+	defer s.Stop()
+
+	dialer := func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	list_services := func(ctx context.Context) ([]string, error) {
+		stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+		}))
+
+		response, err := stream.Recv()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var services []string
+
+		for _, service := range response.GetListServicesResponse().GetService() {
+			services = append(services, service.GetName())
+		}
+
+		return services, nil
+	}
+
+	_, err = list_services(context.Background())
+
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	services, err := list_services(metadata.AppendToOutgoingContext(context.Background(), API_KEY_METADATA_KEY, "reader-secret"))
+
+	require.NoError(t, err)
+	require.Contains(t, services, "atlant.v1.Api")
+
+	defer func() { public_reflection = false }()
+
+	public_reflection = true
+
+	services, err = list_services(context.Background())
+
+	require.NoError(t, err)
+	require.Contains(t, services, "atlant.v1.Api")
+}
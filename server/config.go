@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONFIG_FLAG = "config"
+	ENV_PREFIX  = "ATLANT_"
+
+	ERROR_CONFIG_FORMAT   = "Config file must end in .yaml, .yml or .toml"
+	ERROR_UNKNOWN_SETTING = "Unknown setting"
+	ERROR_SETTING_VALUE   = "Setting must be a string, number, boolean or list"
+)
+
+// config_file holds settings named after the flags, e.g. fetch_timeout: 5m
+var config_file string
+
+// EnvName is the variable overriding the config file for a flag, e.g.
+// ATLANT_MONGO_URI for --mongo_uri
+func EnvName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(name)
+}
+
+// ApplyConfig fills the flags not given on the command line from the
+// ATLANT_* variables in environ, then from the config file. The file is
+// --config, or $ATLANT_CONFIG when the flag is not given.
+func ApplyConfig(flags *flag.FlagSet, environ []string) error {
+	given := map[string]bool{}
+
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	env := map[string]string{}
+
+	for _, pair := range environ {
+		if i := strings.Index(pair, "="); i > 0 && strings.HasPrefix(pair, ENV_PREFIX) {
+			env[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	settings := map[string]string{}
+
+	file := flags.Lookup(CONFIG_FLAG).Value.String()
+
+	if path, ok := env[EnvName(CONFIG_FLAG)]; ok && !given[CONFIG_FLAG] {
+		file = path
+	}
+
+	if file != "" {
+		loaded, err := LoadConfigFile(file)
+
+		if err != nil {
+			return err
+		}
+
+		for name, value := range loaded {
+			if name == CONFIG_FLAG || flags.Lookup(name) == nil {
+				return fmt.Errorf("%s in %s: %s", ERROR_UNKNOWN_SETTING, file, name)
+			}
+
+			settings[name] = value
+		}
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if value, ok := env[EnvName(f.Name)]; ok && f.Name != CONFIG_FLAG {
+			settings[f.Name] = value
+		}
+	})
+
+	names := make([]string, 0, len(settings))
+
+	for name := range settings {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+
+		if err := flags.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("Invalid value %q for %s: %v", settings[name], name, err)
+		}
+	}
+
+	return nil
+}
+
+// LoadConfigFile reads a flat YAML or TOML file of flag names and values,
+// lists become comma separated values
+func LoadConfigFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: %s", ERROR_CONFIG_FORMAT, file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	settings := map[string]string{}
+
+	for name, value := range raw {
+		setting, err := ConfigValue(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: %s", err, file, name)
+		}
+
+		settings[name] = setting
+	}
+
+	return settings, nil
+}
+
+func ConfigValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(value))
+
+		for i, item := range value {
+			setting, err := ConfigValue(item)
+
+			if err != nil {
+				return "", err
+			}
+
+			items[i] = setting
+		}
+
+		return strings.Join(items, ","), nil
+	}
+
+	return "", fmt.Errorf("%s", ERROR_SETTING_VALUE)
+}
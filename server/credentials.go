@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	ERROR_UNKNOWN_CREDENTIAL   = "Unknown credential"
+	ERROR_CREDENTIAL_HOSTS     = "Credential must list the hosts it may be sent to"
+	ERROR_CREDENTIAL_HOST      = "Credential may not be sent to host"
+	ERROR_CREDENTIAL_CA_CERT   = "Cannot parse CA certificate"
+	ERROR_CREDENTIAL_CLIENT_KP = "Client certificate requires both client_cert and client_key"
+)
+
+var credentials_file = ""
+
+var feed_credentials = map[string]*Credential{}
+
+// credential_fetchers holds a dedicated Fetcher for every configured
+// credential, client certificates need their own transport
+var credential_fetchers = map[string]*Fetcher{}
+
+// Credential describes how to authenticate against a feed server. It is
+// configured on the server and referenced by name from FetchRequest, so
+// secrets never travel over RPC. String values may refer to environment
+// variables as $NAME or ${NAME}. Hosts are bucket names for s3:// feeds.
+type Credential struct {
+	Hosts      []string          `json:"hosts"`
+	Username   string            `json:"username"`
+	Password   string            `json:"password"`
+	Token      string            `json:"token"`
+	Headers    map[string]string `json:"headers"`
+	ClientCert string            `json:"client_cert"`
+	ClientKey  string            `json:"client_key"`
+	CACert     string            `json:"ca_cert"`
+	PrivateKey string            `json:"private_key"`
+	AccessKey  string            `json:"access_key"`
+	SecretKey  string            `json:"secret_key"`
+}
+
+// LoadCredentials reads a JSON object of named credentials
+func LoadCredentials(file_path string) (map[string]*Credential, error) {
+	data, err := ioutil.ReadFile(file_path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials map[string]*Credential
+
+	err = json.Unmarshal(data, &credentials)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name, credential := range credentials {
+		credential.ExpandEnv()
+
+		err = credential.Validate()
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return credentials, nil
+}
+
+// BuildCredentialFetchers creates a Fetcher per credential
+func BuildCredentialFetchers(credentials map[string]*Credential, policy *URLPolicy) (map[string]*Fetcher, error) {
+	fetchers := map[string]*Fetcher{}
+
+	for name, credential := range credentials {
+		fetcher := NewFetcher(policy)
+
+		tls_config, err := credential.TLSConfig()
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if tls_config != nil {
+			fetcher.Client.Transport.(*http.Transport).TLSClientConfig = tls_config
+		}
+
+		fetcher.Credential = credential
+		fetcher.Client.CheckRedirect = CheckRedirects(policy, max_redirects, credential)
+
+		fetchers[name] = fetcher
+	}
+
+	return fetchers, nil
+}
+
+// CredentialFor looks a credential up by name, nil for an empty name
+func CredentialFor(name string) (*Credential, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	credential, ok := feed_credentials[name]
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", ERROR_UNKNOWN_CREDENTIAL, name)
+	}
+
+	return credential, nil
+}
+
+// FetcherFor returns the Fetcher to download a feed with the named
+// credential, an empty name means anonymous access.
+func FetcherFor(name string) (*Fetcher, error) {
+	if name == "" {
+		return feed_fetcher, nil
+	}
+
+	fetcher, ok := credential_fetchers[name]
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", ERROR_UNKNOWN_CREDENTIAL, name)
+	}
+
+	return fetcher, nil
+}
+
+func (c *Credential) ExpandEnv() {
+	c.Username = os.ExpandEnv(c.Username)
+	c.Password = os.ExpandEnv(c.Password)
+	c.Token = os.ExpandEnv(c.Token)
+	c.ClientCert = os.ExpandEnv(c.ClientCert)
+	c.ClientKey = os.ExpandEnv(c.ClientKey)
+	c.CACert = os.ExpandEnv(c.CACert)
+	c.PrivateKey = os.ExpandEnv(c.PrivateKey)
+	c.AccessKey = os.ExpandEnv(c.AccessKey)
+	c.SecretKey = os.ExpandEnv(c.SecretKey)
+
+	for key, value := range c.Headers {
+		c.Headers[key] = os.ExpandEnv(value)
+	}
+}
+
+func (c *Credential) Validate() error {
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("%s", ERROR_CREDENTIAL_HOSTS)
+	}
+
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return fmt.Errorf("%s", ERROR_CREDENTIAL_CLIENT_KP)
+	}
+
+	return nil
+}
+
+// HostAllowed keeps a caller from sending a credential to a host of their
+// choice, patterns are the same as in URLPolicy.
+func (c *Credential) HostAllowed(host string) bool {
+	host = NormalizeHost(host)
+
+	for _, pattern := range c.Hosts {
+		if MatchHost(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Credential) CheckHost(host string) error {
+	if !c.HostAllowed(host) {
+		return &PolicyError{ERROR_CREDENTIAL_HOST, host}
+	}
+
+	return nil
+}
+
+// Apply adds authentication to an outgoing request
+func (c *Credential) Apply(request *http.Request) {
+	if c.Username != "" || c.Password != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+
+	if c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	for key, value := range c.Headers {
+		request.Header.Set(key, value)
+	}
+}
+
+// Strip removes everything Apply added, used when a redirect leaves the
+// credential hosts
+func (c *Credential) Strip(request *http.Request) {
+	request.Header.Del("Authorization")
+
+	for key := range c.Headers {
+		request.Header.Del(key)
+	}
+}
+
+// TLSConfig returns nil when the default TLS settings are fine
+func (c *Credential) TLSConfig() (*tls.Config, error) {
+	if c.ClientCert == "" && c.CACert == "" {
+		return nil, nil
+	}
+
+	tls_config := &tls.Config{}
+
+	if c.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tls_config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if c.CACert != "" {
+		data, err := ioutil.ReadFile(c.CACert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: %s", ERROR_CREDENTIAL_CA_CERT, c.CACert)
+		}
+
+		tls_config.RootCAs = pool
+	}
+
+	return tls_config, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCredentials(t *testing.T, content string) string {
+	file_path := filepath.Join(t.TempDir(), "credentials.json")
+
+	require.NoError(t, ioutil.WriteFile(file_path, []byte(content), 0600))
+
+	return file_path
+}
+
+func credentialFetcher(t *testing.T, content string, name string) *Fetcher {
+	credentials, err := LoadCredentials(writeCredentials(t, content))
+	require.NoError(t, err)
+
+	fetchers, err := BuildCredentialFetchers(credentials, url_policy)
+	require.NoError(t, err)
+
+	fetchers[name].RetryBackoff = time.Millisecond
+
+	return fetchers[name]
+}
+
+func TestLoadCredentials(t *testing.T) {
+	os.Setenv("ATLANT_TEST_FEED_TOKEN", "secret")
+	defer os.Unsetenv("ATLANT_TEST_FEED_TOKEN")
+
+	credentials, err := LoadCredentials(writeCredentials(t, `{
+		"supplier": {"hosts": ["feeds.supplier.com"], "token": "${ATLANT_TEST_FEED_TOKEN}"}
+	}`))
+
+	require.NoError(t, err)
+	require.Equal(t, "secret", credentials["supplier"].Token)
+
+	_, err = LoadCredentials(writeCredentials(t, `{"supplier": {"token": "secret"}}`))
+
+	require.Error(t, err)
+
+	_, err = LoadCredentials(writeCredentials(t, `{"supplier": {"hosts": ["a.com"], "client_cert": "cert.pem"}}`))
+
+	require.Error(t, err)
+}
+
+func TestCredentialAuthentication(t *testing.T) {
+	var received http.Header
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+	}))
+
+	defer ts.Close()
+
+	fetcher := credentialFetcher(t, `{
+		"basic": {"hosts": ["127.0.0.1"], "username": "user", "password": "pass"},
+		"bearer": {"hosts": ["127.0.0.1"], "token": "abc", "headers": {"X-Api-Key": "key"}}
+	}`, "basic")
+
+	_, _, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, "Basic dXNlcjpwYXNz", received.Get("Authorization"))
+
+	fetcher = credentialFetcher(t, `{"bearer": {"hosts": ["127.0.0.1"], "token": "abc", "headers": {"X-Api-Key": "key"}}}`, "bearer")
+
+	_, _, err = fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, "Bearer abc", received.Get("Authorization"))
+	require.Equal(t, "key", received.Get("X-Api-Key"))
+}
+
+func TestCredentialIsLimitedToItsHosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+	}))
+
+	defer ts.Close()
+
+	fetcher := credentialFetcher(t, `{"supplier": {"hosts": ["feeds.supplier.com"], "token": "abc"}}`, "supplier")
+
+	_, _, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.Error(t, err)
+	require.Equal(t, codes.PermissionDenied, DownloadErrorCode(err))
+}
+
+func TestCredentialIsStrippedOnForeignRedirect(t *testing.T) {
+	var received http.Header
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+	}))
+
+	defer other.Close()
+
+	// same address under another name, so the credential host no longer matches
+	other_url, err := url.Parse(other.URL)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+other_url.Port()+"/", http.StatusFound)
+	}))
+
+	defer ts.Close()
+
+	fetcher := credentialFetcher(t, `{"supplier": {"hosts": ["127.0.0.1"], "token": "abc", "headers": {"X-Api-Key": "key"}}}`, "supplier")
+
+	_, _, err = fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.NoError(t, err)
+	require.Empty(t, received.Get("Authorization"))
+	require.Empty(t, received.Get("X-Api-Key"))
+}
+
+func TestCredentialClientCertificate(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+	}))
+
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+
+	defer ts.Close()
+
+	directory := t.TempDir()
+
+	ca_path := filepath.Join(directory, "ca.pem")
+	cert_path, key_path := writeClientCertificate(t, directory)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(ca_path, ca, 0600))
+
+	fetcher := credentialFetcher(t, `{"supplier": {"hosts": ["127.0.0.1"],
+		"client_cert": "`+cert_path+`", "client_key": "`+key_path+`", "ca_cert": "`+ca_path+`"}}`, "supplier")
+
+	_, body, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, "PRODUCT NAME;PRICE\n", string(body))
+}
+
+func TestFetcherForUnknownCredential(t *testing.T) {
+	_, err := FetcherFor("missing")
+
+	require.Error(t, err)
+	require.Equal(t, codes.InvalidArgument, DownloadErrorCode(err))
+}
+
+func writeClientCertificate(t *testing.T, directory string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "atlant"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	key_der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cert_path := filepath.Join(directory, "client.pem")
+	key_path := filepath.Join(directory, "client.key")
+
+	require.NoError(t, ioutil.WriteFile(cert_path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(key_path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600))
+
+	return cert_path, key_path
+}
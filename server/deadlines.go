@@ -0,0 +1,54 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	DEFAULT_FETCH_TIMEOUT = 10 * time.Minute
+	DEFAULT_LIST_TIMEOUT  = 30 * time.Second
+)
+
+var fetch_timeout = DEFAULT_FETCH_TIMEOUT
+var list_timeout = DEFAULT_LIST_TIMEOUT
+
+// MethodTimeout is the longest a call of method may run on the server, the
+// client's own deadline applies when it is shorter. Zero means no limit.
+func MethodTimeout(method string) time.Duration {
+	if method == MethodName("Fetch") {
+		return fetch_timeout
+	}
+
+	return list_timeout
+}
+
+func DeadlineUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if timeout := MethodTimeout(info.FullMethod); timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+
+		defer cancel()
+	}
+
+	return handler(ctx, req)
+}
+
+// StoreError reports a failed MongoDB call. When the call's context is done
+// the caller learns it was cancelled or timed out, anything else is
+// UNAVAILABLE so that the client retries.
+func StoreError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+
+	slog.ErrorContext(ctx, "MongoDB error", "error", err)
+
+	return status.Errorf(codes.Unavailable, "%v", err)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadlineInterceptor(t *testing.T) {
+	defer func(fetch, list time.Duration) {
+		fetch_timeout, list_timeout = fetch, list
+	}(fetch_timeout, list_timeout)
+
+	fetch_timeout = time.Hour
+	list_timeout = time.Second
+
+	remaining := func(ctx context.Context, method string) time.Duration {
+		var left time.Duration
+
+		_, err := DeadlineUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: MethodName(method)}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			if deadline, ok := ctx.Deadline(); ok {
+				left = time.Until(deadline)
+			}
+
+			return nil, nil
+		})
+
+		require.NoError(t, err)
+
+		return left
+	}
+
+	require.InDelta(t, float64(time.Hour), float64(remaining(context.Background(), "Fetch")), float64(time.Second))
+	require.InDelta(t, float64(time.Second), float64(remaining(context.Background(), "List")), float64(100*time.Millisecond))
+
+	// a shorter client deadline wins
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	defer cancel()
+
+	require.InDelta(t, float64(time.Minute), float64(remaining(ctx, "Fetch")), float64(time.Second))
+
+	fetch_timeout = 0
+
+	require.Zero(t, remaining(context.Background(), "Fetch"))
+}
+
+func TestStoreError(t *testing.T) {
+	failure := errors.New("server selection error")
+
+	require.Equal(t, codes.Unavailable, status.Code(StoreError(context.Background(), failure)))
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+
+	defer cancel()
+
+	require.Equal(t, codes.DeadlineExceeded, status.Code(StoreError(expired, failure)))
+
+	cancelled, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	require.Equal(t, codes.Canceled, status.Code(StoreError(cancelled, failure)))
+}
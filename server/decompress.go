@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	DEFAULT_MAX_DECOMPRESSED_SIZE = 512 * 1024 * 1024
+
+	// gzip inside zip inside gzip is fine, anything deeper is most likely a bomb
+	MAX_COMPRESSION_LAYERS = 4
+
+	ERROR_DECOMPRESSED_SIZE    = "Decompressed feed exceeds size limit"
+	ERROR_UNSUPPORTED_ENCODING = "Unsupported content encoding"
+	ERROR_EMPTY_ARCHIVE        = "Archive does not contain CSV files"
+	ERROR_TOO_MANY_LAYERS      = "Too many nested compression layers"
+)
+
+var max_decompressed_size int64 = DEFAULT_MAX_DECOMPRESSED_SIZE
+
+// Decompress unwraps a downloaded feed and returns the CSV payloads inside it.
+// Content-Encoding is undone first, then gzip, zstd and zip containers are
+// detected by their signatures. Every zip member with a .csv extension becomes
+// a separate payload. The total amount of decompressed data is capped by limit.
+func Decompress(body []byte, content_encoding string, limit int64) ([][]byte, error) {
+	budget := limit
+
+	data, err := DecodeContent(body, content_encoding, &budget)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Unpack(data, &budget, 0)
+}
+
+// DecodeContent reverts the codings listed in a Content-Encoding header,
+// which are applied in the order they are listed.
+func DecodeContent(body []byte, content_encoding string, budget *int64) ([]byte, error) {
+	codings := strings.Split(content_encoding, ",")
+
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var err error
+
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			body, err = Gunzip(body, budget)
+		case "zstd":
+			body, err = Unzstd(body, budget)
+		default:
+			err = fmt.Errorf("%s: %s", ERROR_UNSUPPORTED_ENCODING, coding)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+func Unpack(data []byte, budget *int64, depth int) ([][]byte, error) {
+	if depth > MAX_COMPRESSION_LAYERS {
+		return nil, fmt.Errorf("%s", ERROR_TOO_MANY_LAYERS)
+	}
+
+	mime := mimetype.Detect(data)
+
+	var err error
+
+	switch {
+	case mime.Is("application/gzip"):
+		data, err = Gunzip(data, budget)
+	case mime.Is("application/zstd"):
+		data, err = Unzstd(data, budget)
+	case mime.Is("application/zip"):
+		return Unzip(data, budget, depth)
+	default:
+		err = CheckMimeType(mime)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]byte{data}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Unpack(data, budget, depth+1)
+}
+
+func Unzip(data []byte, budget *int64, depth int) ([][]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() || !IsCSVMember(member.Name) {
+			continue
+		}
+
+		reader, err := member.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := ReadLimited(reader, budget)
+
+		reader.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		unpacked, err := Unpack(content, budget, depth+1)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", member.Name, err)
+		}
+
+		payloads = append(payloads, unpacked...)
+	}
+
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("%s", ERROR_EMPTY_ARCHIVE)
+	}
+
+	return payloads, nil
+}
+
+func Gunzip(data []byte, budget *int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return ReadLimited(reader, budget)
+}
+
+func Unzstd(data []byte, budget *int64) ([]byte, error) {
+	reader, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(*budget)+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return ReadLimited(reader, budget)
+}
+
+// ReadLimited reads everything from reader and charges it to budget, failing
+// as soon as the budget is exhausted instead of buffering the whole stream.
+func ReadLimited(reader io.Reader, budget *int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, *budget+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > *budget {
+		return nil, fmt.Errorf("%s", ERROR_DECOMPRESSED_SIZE)
+	}
+
+	*budget -= int64(len(data))
+
+	return data, nil
+}
+
+// IsCSVMember accepts products.csv as well as compressed products.csv.gz or
+// products.csv.zst, skipping hidden entries such as __MACOSX/._products.csv
+func IsCSVMember(name string) bool {
+	if strings.HasPrefix(path.Base(name), ".") {
+		return false
+	}
+
+	name = strings.ToLower(name)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst")
+
+	return path.Ext(name) == ".csv"
+}
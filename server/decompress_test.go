@@ -0,0 +1,177 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+
+	writer := gzip.NewWriter(&buffer)
+
+	_, err := writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	defer encoder.Close()
+
+	return encoder.EncodeAll(data, nil)
+}
+
+func zipData(t *testing.T, members map[string][]byte) []byte {
+	var buffer bytes.Buffer
+
+	writer := zip.NewWriter(&buffer)
+
+	for name, content := range members {
+		member, err := writer.Create(name)
+		require.NoError(t, err)
+
+		_, err = member.Write(content)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+func readSample(t *testing.T) []byte {
+	data, err := ioutil.ReadFile("../samples/small_csv_sample.csv")
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestDecompressPlainCSV(t *testing.T) {
+	sample := readSample(t)
+
+	payloads, err := Decompress(sample, "", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{sample}, payloads)
+}
+
+func TestDecompressGzipAndZstd(t *testing.T) {
+	sample := readSample(t)
+
+	payloads, err := Decompress(gzipData(t, sample), "", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{sample}, payloads)
+
+	payloads, err = Decompress(zstdData(t, sample), "", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{sample}, payloads)
+}
+
+func TestDecompressContentEncoding(t *testing.T) {
+	sample := readSample(t)
+
+	body := zstdData(t, gzipData(t, sample))
+
+	payloads, err := Decompress(body, "gzip, zstd", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{sample}, payloads)
+
+	_, err = Decompress(sample, "br", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.Error(t, err)
+}
+
+func TestDecompressZipMembers(t *testing.T) {
+	sample := readSample(t)
+
+	archive := zipData(t, map[string][]byte{
+		"first.csv":            sample,
+		"nested/second.csv.gz": gzipData(t, sample),
+		"readme.txt":           []byte("not a feed"),
+		"__MACOSX/._first.csv": []byte{0, 5, 22, 7},
+	})
+
+	payloads, err := Decompress(archive, "", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.NoError(t, err)
+	require.Len(t, payloads, 2)
+
+	for _, payload := range payloads {
+		require.Equal(t, sample, payload)
+	}
+}
+
+func TestDecompressZipWithoutCSV(t *testing.T) {
+	archive := zipData(t, map[string][]byte{"readme.txt": []byte("not a feed")})
+
+	_, err := Decompress(archive, "", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.EqualError(t, err, ERROR_EMPTY_ARCHIVE)
+}
+
+func TestDecompressRejectsBombs(t *testing.T) {
+	bomb := gzipData(t, bytes.Repeat([]byte("a"), 1024*1024))
+
+	_, err := Decompress(bomb, "", 1024)
+
+	require.EqualError(t, err, ERROR_DECOMPRESSED_SIZE)
+
+	sample := readSample(t)
+
+	archive := zipData(t, map[string][]byte{"first.csv": sample, "second.csv": sample})
+
+	_, err = Decompress(archive, "", int64(len(sample)*2-1))
+
+	require.EqualError(t, err, ERROR_DECOMPRESSED_SIZE)
+}
+
+func TestDecompressRejectsBinaryPayload(t *testing.T) {
+	image, err := ioutil.ReadFile("../samples/golang.png")
+	require.NoError(t, err)
+
+	_, err = Decompress(gzipData(t, image), "", DEFAULT_MAX_DECOMPRESSED_SIZE)
+
+	require.EqualError(t, err, ERROR_INCORRECT_FILE_TYPE)
+}
+
+func TestDownloadCompressedFile(t *testing.T) {
+	sample := readSample(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipData(t, zipData(t, map[string][]byte{"a.csv": sample, "b.csv.zst": zstdData(t, sample)})))
+	}))
+
+	defer ts.Close()
+
+	file_paths, err := DownloadFile(context.Background(), ts.URL, "", RandomFile("../tmp", 64), nil)
+
+	defer DeleteFiles(file_paths)
+
+	require.NoError(t, err)
+	require.Len(t, file_paths, 2)
+
+	for _, file_path := range file_paths {
+		data, err := ioutil.ReadFile(file_path)
+
+		require.NoError(t, err)
+		require.Equal(t, sample, data)
+	}
+}
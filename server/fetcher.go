@@ -0,0 +1,281 @@
+package main
+
+import (
+	"google.golang.org/grpc/codes"
+
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT = 10 * time.Second
+	DEFAULT_READ_TIMEOUT    = 60 * time.Second
+	DEFAULT_FETCH_RETRIES   = 3
+	DEFAULT_RETRY_BACKOFF   = 500 * time.Millisecond
+	DEFAULT_MAX_BODY_SIZE   = 256 * 1024 * 1024
+	DEFAULT_MAX_REDIRECTS   = 5
+
+	ERROR_BODY_TOO_LARGE    = "Feed exceeds size limit"
+	ERROR_UNEXPECTED_STATUS = "Unexpected HTTP status"
+)
+
+var ErrTooManyRedirects = errors.New("Too many redirects")
+
+var connect_timeout = DEFAULT_CONNECT_TIMEOUT
+var read_timeout = DEFAULT_READ_TIMEOUT
+var fetch_retries = DEFAULT_FETCH_RETRIES
+var retry_backoff = DEFAULT_RETRY_BACKOFF
+var max_body_size int64 = DEFAULT_MAX_BODY_SIZE
+var max_redirects = DEFAULT_MAX_REDIRECTS
+
+// feed_fetcher is rebuilt by main once flags are parsed
+var feed_fetcher = NewFetcher(url_policy)
+
+// Fetcher is an HTTP client for feed downloads with bounded time, size and
+// redirects, which retries transient failures and only talks to the hosts
+// and addresses permitted by its URLPolicy.
+type Fetcher struct {
+	Client       *http.Client
+	Policy       *URLPolicy
+	Credential   *Credential
+	MaxBodySize  int64
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// StatusError is returned for any response outside of 2xx and 304
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", ERROR_UNEXPECTED_STATUS, e.Status)
+}
+
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// NewFetcher builds a Fetcher from the fetch flags. Proxies are not used on
+// purpose: the policy has to see the address we actually connect to.
+func NewFetcher(policy *URLPolicy) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout: connect_timeout,
+		Control: policy.Control,
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: connect_timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport:     transport,
+		Timeout:       read_timeout,
+		CheckRedirect: CheckRedirects(policy, max_redirects, nil),
+	}
+
+	return &Fetcher{
+		Client:       client,
+		Policy:       policy,
+		MaxBodySize:  max_body_size,
+		Retries:      fetch_retries,
+		RetryBackoff: retry_backoff,
+	}
+}
+
+// CheckRedirects enforces the redirect limit and the URL policy on every hop
+// and drops the credential once a redirect leaves its hosts.
+func CheckRedirects(policy *URLPolicy, limit int, credential *Credential) func(*http.Request, []*http.Request) error {
+	return func(request *http.Request, via []*http.Request) error {
+		if len(via) > limit {
+			return ErrTooManyRedirects
+		}
+
+		if credential != nil && !credential.HostAllowed(request.URL.Hostname()) {
+			credential.Strip(request)
+		}
+
+		return policy.CheckURL(request.URL)
+	}
+}
+
+// Get downloads url and returns the response together with its body. prepare
+// is called on every attempt to add request headers. Network errors, 5xx and
+// 429 responses are retried with exponential backoff until ctx is done. A
+// 304 response is returned as is with an empty body.
+func (f *Fetcher) Get(ctx context.Context, feed_url string, prepare func(*http.Request)) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := f.try(ctx, feed_url, prepare)
+
+		if err == nil || ctx.Err() != nil || !Retryable(err) || attempt >= f.Retries {
+			return resp, body, err
+		}
+
+		delay := f.RetryBackoff << uint(attempt)
+
+		slog.WarnContext(ctx, "Retrying download", "url", feed_url, "delay", delay.String(), "error", err)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (f *Fetcher) try(ctx context.Context, feed_url string, prepare func(*http.Request)) (*http.Response, []byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, feed_url, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = f.Policy.CheckURL(request.URL)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if f.Credential != nil {
+		err = f.Credential.CheckHost(request.URL.Hostname())
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		f.Credential.Apply(request)
+	}
+
+	// asking for compression explicitly stops the transport from inflating
+	// gzip behind our back, so the size limits apply to every feed
+	request.Header.Set("Accept-Encoding", "gzip, zstd")
+
+	if prepare != nil {
+		prepare(request)
+	}
+
+	resp, err := f.Client.Do(request)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return resp, nil, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, nil, &StatusError{resp.StatusCode, resp.Status}
+	}
+
+	body, err := ReadBody(resp.Body, resp.ContentLength, f.MaxBodySize)
+
+	return resp, body, err
+}
+
+// ReadBody reads at most limit bytes, size is the announced length or -1
+func ReadBody(reader io.Reader, size int64, limit int64) ([]byte, error) {
+	if size > limit {
+		return nil, fmt.Errorf("%s", ERROR_BODY_TOO_LARGE)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%s", ERROR_BODY_TOO_LARGE)
+	}
+
+	return body, nil
+}
+
+// Retryable tells transient download failures from permanent ones
+func Retryable(err error) bool {
+	var status_error *StatusError
+	var policy_error *PolicyError
+
+	if errors.As(err, &status_error) {
+		return status_error.Temporary()
+	}
+
+	if errors.As(err, &policy_error) {
+		return false
+	}
+
+	if errors.Is(err, ErrTooManyRedirects) {
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var net_error net.Error
+
+	return errors.As(UnwrapURLError(err), &net_error)
+}
+
+// UnwrapURLError strips *url.Error, which claims to be a net.Error even for
+// malformed URLs and unsupported schemes.
+func UnwrapURLError(err error) error {
+	var url_error *url.Error
+
+	if errors.As(err, &url_error) {
+		return url_error.Err
+	}
+
+	return err
+}
+
+// DownloadErrorCode picks the gRPC status code reported for a failed download
+func DownloadErrorCode(err error) codes.Code {
+	var status_error *StatusError
+	var policy_error *PolicyError
+	var net_error net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.As(err, &policy_error):
+		return codes.PermissionDenied
+	case errors.As(err, &status_error):
+		if status_error.Temporary() {
+			return codes.Unavailable
+		}
+
+		return codes.FailedPrecondition
+	case errors.Is(err, ErrTooManyRedirects):
+		return codes.FailedPrecondition
+	case errors.As(UnwrapURLError(err), &net_error):
+		if net_error.Timeout() {
+			return codes.DeadlineExceeded
+		}
+
+		return codes.Unavailable
+	}
+
+	return codes.InvalidArgument
+}
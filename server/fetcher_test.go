@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// test feeds are served by httptest on the loopback interface
+	url_policy = MustURLPolicy("http,https,file,sftp,s3", "", "", "")
+	feed_fetcher = NewFetcher(url_policy)
+
+	os.Exit(m.Run())
+}
+
+func testFetcher() *Fetcher {
+	fetcher := NewFetcher(url_policy)
+	fetcher.RetryBackoff = time.Millisecond
+
+	return fetcher
+}
+
+func TestFetcherRetriesServerErrors(t *testing.T) {
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+	}))
+
+	defer ts.Close()
+
+	_, body, err := testFetcher().Get(context.Background(), ts.URL, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, "PRODUCT NAME;PRICE\n", string(body))
+	require.Equal(t, 3, requests)
+}
+
+func TestFetcherGivesUpAfterRetries(t *testing.T) {
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	defer ts.Close()
+
+	fetcher := testFetcher()
+	fetcher.Retries = 2
+
+	_, _, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.EqualError(t, err, ERROR_UNEXPECTED_STATUS+": 502 Bad Gateway")
+	require.Equal(t, 3, requests)
+	require.Equal(t, codes.Unavailable, DownloadErrorCode(err))
+}
+
+func TestFetcherDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		http.NotFound(w, r)
+	}))
+
+	defer ts.Close()
+
+	_, _, err := testFetcher().Get(context.Background(), ts.URL, nil)
+
+	require.Error(t, err)
+	require.Equal(t, 1, requests)
+	require.Equal(t, codes.FailedPrecondition, DownloadErrorCode(err))
+}
+
+func TestFetcherLimitsBodySize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2048))
+	}))
+
+	defer ts.Close()
+
+	fetcher := testFetcher()
+	fetcher.MaxBodySize = 1024
+
+	_, _, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.EqualError(t, err, ERROR_BODY_TOO_LARGE)
+	require.Equal(t, codes.InvalidArgument, DownloadErrorCode(err))
+}
+
+func TestFetcherLimitsRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/again", http.StatusFound)
+	}))
+
+	defer ts.Close()
+
+	fetcher := testFetcher()
+	fetcher.Client.CheckRedirect = CheckRedirects(fetcher.Policy, 2, nil)
+
+	_, _, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.Error(t, err)
+	require.False(t, Retryable(err))
+	require.Equal(t, codes.FailedPrecondition, DownloadErrorCode(err))
+}
+
+func TestFetcherTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+
+	defer ts.Close()
+
+	fetcher := testFetcher()
+	fetcher.Retries = 0
+	fetcher.Client.Timeout = 50 * time.Millisecond
+
+	_, _, err := fetcher.Get(context.Background(), ts.URL, nil)
+
+	require.Error(t, err)
+	require.Equal(t, codes.DeadlineExceeded, DownloadErrorCode(err))
+}
+
+func TestFetcherRejectsMalformedURL(t *testing.T) {
+	_, _, err := testFetcher().Get(context.Background(), "http://[::1", nil)
+
+	require.Error(t, err)
+	require.False(t, Retryable(err))
+	require.Equal(t, codes.InvalidArgument, DownloadErrorCode(err))
+}
+
+func TestFetcherStopsAtDeadline(t *testing.T) {
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer ts.Close()
+
+	fetcher := testFetcher()
+	fetcher.Retries = 10
+	fetcher.RetryBackoff = time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+
+	defer cancel()
+
+	started := time.Now()
+
+	_, _, err := fetcher.Get(ctx, ts.URL, nil)
+
+	require.Less(t, int64(time.Since(started)), int64(time.Second))
+	require.Equal(t, 1, requests)
+	require.Equal(t, codes.DeadlineExceeded, DownloadErrorCode(err))
+}
+
+func TestFetcherCancelledDuringTransfer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, _, err := testFetcher().Get(ctx, ts.URL, nil)
+
+	require.Equal(t, codes.Canceled, DownloadErrorCode(err))
+}
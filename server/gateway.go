@@ -0,0 +1,326 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_GATEWAY_PORT = 55557
+
+	GATEWAY_PREFIX = "/v1/"
+	OPENAPI_PATH   = "/openapi.json"
+
+	// the gateway tells the backend who called it with this metadata, which
+	// is only believed along with gateway_secret
+	GATEWAY_METADATA_PREFIX     = "x-atlant-gateway-"
+	GATEWAY_SECRET_METADATA_KEY = GATEWAY_METADATA_PREFIX + "secret"
+	GATEWAY_PEER_METADATA_KEY   = GATEWAY_METADATA_PREFIX + "peer"
+	GATEWAY_CERT_METADATA_KEY   = GATEWAY_METADATA_PREFIX + "cert-bin"
+
+	GATEWAY_SECRET_SIZE = 32
+
+	// slow or idle HTTP clients can't hold connections open for long, the
+	// calls themselves are bounded by fetch_timeout and list_timeout
+	GATEWAY_READ_HEADER_TIMEOUT = 10 * time.Second
+	GATEWAY_IDLE_TIMEOUT        = 2 * time.Minute
+)
+
+var gateway_port = DEFAULT_GATEWAY_PORT
+
+// gateway_secret never leaves the process, so only our gateway can vouch
+// for the caller's address and certificate
+var gateway_secret = NewGatewaySecret()
+
+// gateway_headers are passed on to the gRPC calls as the metadata the
+// interceptors look for, Authorization is passed on by the gateway itself
+var gateway_headers = map[string]string{
+	textproto.CanonicalMIMEHeaderKey(API_KEY_METADATA_KEY):        API_KEY_METADATA_KEY,
+	textproto.CanonicalMIMEHeaderKey(TENANT_METADATA_KEY):         TENANT_METADATA_KEY,
+	textproto.CanonicalMIMEHeaderKey(RPC_REQUEST_ID_METADATA_KEY): RPC_REQUEST_ID_METADATA_KEY,
+}
+
+// list_query_aliases are the friendlier names of the List parameters, e.g.
+// GET /v1/products?sort=price&order=asc&page=1
+var list_query_aliases = map[string]string{
+	"sort":     "column",
+	"page":     "page_number",
+	"per_page": "results_per_page",
+}
+
+var list_orders = map[string]string{
+	"asc":  api.SortOrder_SORT_ORDER_ASC.String(),
+	"desc": api.SortOrder_SORT_ORDER_DESC.String(),
+}
+
+func GatewayHeaderMatcher(key string) (string, bool) {
+	if name, ok := gateway_headers[textproto.CanonicalMIMEHeaderKey(key)]; ok {
+		return name, true
+	}
+
+	name, ok := runtime.DefaultHeaderMatcher(key)
+
+	// callers must not pass off their own Grpc-Metadata- headers as ours
+	if ok && strings.HasPrefix(strings.ToLower(name), GATEWAY_METADATA_PREFIX) {
+		return "", false
+	}
+
+	return name, ok
+}
+
+func NewGatewaySecret() string {
+	data := make([]byte, GATEWAY_SECRET_SIZE)
+
+	_, err := rand.Read(data)
+
+	ErrorCheck(err)
+
+	return hex.EncodeToString(data)
+}
+
+// GatewayMetadata passes on the address of the HTTP caller and the client
+// certificate its TLS connection verified, the backend sees neither
+func GatewayMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	md := metadata.Pairs(GATEWAY_SECRET_METADATA_KEY, gateway_secret)
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		md.Set(GATEWAY_PEER_METADATA_KEY, host)
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		md.Set(GATEWAY_CERT_METADATA_KEY, string(r.TLS.VerifiedChains[0][0].Raw))
+	}
+
+	return md
+}
+
+// FromGateway returns the metadata of a call made by our gateway, nil for
+// any other call
+func FromGateway(ctx context.Context) metadata.MD {
+	md, ok := metadata.FromIncomingContext(ctx)
+
+	if !ok {
+		return nil
+	}
+
+	secret := md.Get(GATEWAY_SECRET_METADATA_KEY)
+
+	if len(secret) != 1 || subtle.ConstantTimeCompare([]byte(secret[0]), []byte(gateway_secret)) != 1 {
+		return nil
+	}
+
+	return md
+}
+
+// GatewayPeer is the address of the HTTP caller of a gateway call
+func GatewayPeer(ctx context.Context) string {
+	if values := FromGateway(ctx).Get(GATEWAY_PEER_METADATA_KEY); len(values) == 1 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// GatewayCertificate is the client certificate the gateway verified
+func GatewayCertificate(ctx context.Context) *x509.Certificate {
+	values := FromGateway(ctx).Get(GATEWAY_CERT_METADATA_KEY)
+
+	if len(values) != 1 {
+		return nil
+	}
+
+	certificate, err := x509.ParseCertificate([]byte(values[0]))
+
+	if err != nil {
+		return nil
+	}
+
+	return certificate
+}
+
+// GatewayResponseHeaderMatcher returns the request id as X-Request-Id and
+// the rest of the response metadata with the usual Grpc-Metadata- prefix
+func GatewayResponseHeaderMatcher(key string) (string, bool) {
+	if key == RPC_REQUEST_ID_METADATA_KEY {
+		return textproto.CanonicalMIMEHeaderKey(key), true
+	}
+
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// ListQueryParser accepts the aliases of the List parameters and asc or
+// desc as the order
+type ListQueryParser struct {
+	runtime.DefaultQueryParser
+}
+
+func (p *ListQueryParser) Parse(msg proto.Message, values url.Values, filter *utilities.DoubleArray) error {
+	if _, ok := msg.(*api.ListRequest); ok {
+		values = ListQueryValues(values)
+	}
+
+	return p.DefaultQueryParser.Parse(msg, values, filter)
+}
+
+func ListQueryValues(values url.Values) url.Values {
+	translated := url.Values{}
+
+	for key, value := range values {
+		translated[key] = value
+	}
+
+	for alias, name := range list_query_aliases {
+		if value, ok := values[alias]; ok {
+			delete(translated, alias)
+
+			if _, ok := values[name]; !ok {
+				translated[name] = value
+			}
+		}
+	}
+
+	if order, ok := list_orders[strings.ToLower(translated.Get("order"))]; ok {
+		translated.Set("order", order)
+	}
+
+	return translated
+}
+
+// NewGateway serves the REST/JSON API by calling the gRPC server behind
+// conn, fields keep their proto names
+func NewGateway(ctx context.Context, conn *grpc.ClientConn) (http.Handler, error) {
+	gateway := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(GatewayHeaderMatcher),
+		runtime.WithOutgoingHeaderMatcher(GatewayResponseHeaderMatcher),
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+		runtime.SetQueryParameterParser(&ListQueryParser{}),
+		runtime.WithMetadata(GatewayMetadata),
+	)
+
+	if err := api.RegisterApiHandler(ctx, gateway, conn); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+
+	// the trace of the HTTP client goes on over the gRPC call
+	mux.Handle(GATEWAY_PREFIX, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		gateway.ServeHTTP(w, r.WithContext(ctx))
+	}))
+
+	mux.HandleFunc(OPENAPI_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(api.OpenAPI)
+	})
+
+	return mux, nil
+}
+
+// StartGateway serves the gateway on address. Its calls go to a plaintext
+// gRPC server on the loopback interface built with options, the same
+// interceptors as the public server but no TLS. The HTTP server uses
+// tls_config when it is set, the caller's address and certificate reach
+// the backend through GatewayMetadata.
+func StartGateway(address string, options []grpc.ServerOption, service api.ApiServer, tls_config *tls.Config) (*http.Server, *grpc.Server, error) {
+	backend_listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend := grpc.NewServer(options...)
+
+	api.RegisterApiServer(backend, service)
+
+	go backend.Serve(backend_listener)
+
+	conn, err := grpc.Dial(backend_listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
+
+	if err != nil {
+		backend.Stop()
+
+		return nil, nil, err
+	}
+
+	handler, err := NewGateway(context.Background(), conn)
+
+	if err != nil {
+		backend.Stop()
+
+		return nil, nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+
+	if err == nil {
+		listener, err = NewProxyListener(listener, proxy_networks)
+	}
+
+	if err != nil {
+		backend.Stop()
+
+		return nil, nil, err
+	}
+
+	gateway := NewGatewayServer(address, handler, tls_config)
+
+	go func() {
+		if tls_config != nil {
+			listener = tls.NewListener(listener, tls_config)
+		}
+
+		err := gateway.Serve(listener)
+
+		slog.Info("REST gateway stopped", "error", err)
+	}()
+
+	return gateway, backend, nil
+}
+
+// NewGatewayServer has no write timeout, which would cut off imports and
+// WatchPriceChanges streams. Request bodies are small, they must arrive
+// within list_timeout.
+func NewGatewayServer(address string, handler http.Handler, tls_config *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		TLSConfig:         tls_config,
+		ReadHeaderTimeout: GATEWAY_READ_HEADER_TIMEOUT,
+		ReadTimeout:       list_timeout,
+		IdleTimeout:       GATEWAY_IDLE_TIMEOUT,
+	}
+}
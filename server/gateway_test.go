@@ -0,0 +1,225 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatewayStub answers List with the parameters it was called with
+type gatewayStub struct {
+	api.UnimplementedApiServer
+}
+
+func (s *gatewayStub) List(ctx context.Context, in *api.ListRequest) (*api.ListResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if len(md.Get(API_KEY_METADATA_KEY)) == 0 {
+		return nil, status.Error(codes.Unauthenticated, ERROR_UNAUTHENTICATED)
+	}
+
+	return &api.ListResponse{Results: []*api.Result{{
+		Product:  in.GetColumn(),
+		Price:    float64(in.GetResultsPerPage()),
+		ImportId: strings.Join(md.Get(TENANT_METADATA_KEY), ","),
+		Source:   strings.Join(md.Get(API_KEY_METADATA_KEY), ","),
+
+		Timespricechanged: in.GetPageNumber(),
+		Requesttime:       timestamppb.New(time.Unix(int64(in.GetOrder()), 0)),
+	}}}, nil
+}
+
+func TestListQueryValues(t *testing.T) {
+	values := ListQueryValues(url.Values{"sort": {"price"}, "order": {"ASC"}, "page": {"2"}, "source": {"a"}})
+
+	require.Equal(t, url.Values{"column": {"price"}, "order": {"SORT_ORDER_ASC"}, "page_number": {"2"}, "source": {"a"}}, values)
+
+	values = ListQueryValues(url.Values{"sort": {"price"}, "column": {"product"}, "order": {"desc"}})
+
+	require.Equal(t, url.Values{"column": {"product"}, "order": {"SORT_ORDER_DESC"}}, values)
+
+	values = ListQueryValues(url.Values{"order": {"SORT_ORDER_DESC"}, "per_page": {"5"}})
+
+	require.Equal(t, url.Values{"order": {"SORT_ORDER_DESC"}, "results_per_page": {"5"}}, values)
+}
+
+func TestGatewayHeaderMatcher(t *testing.T) {
+	for header, name := range map[string]string{"x-api-key": API_KEY_METADATA_KEY, "Atlant-Tenant": TENANT_METADATA_KEY, "X-Request-ID": RPC_REQUEST_ID_METADATA_KEY} {
+		forwarded, ok := GatewayHeaderMatcher(header)
+
+		require.True(t, ok, header)
+		require.Equal(t, name, forwarded)
+	}
+
+	_, ok := GatewayHeaderMatcher("X-Internal")
+
+	require.False(t, ok)
+
+	_, ok = GatewayHeaderMatcher("Grpc-Metadata-X-Atlant-Gateway-Peer")
+
+	require.False(t, ok)
+}
+
+func TestGatewayMetadata(t *testing.T) {
+	ca := newTestCA(t)
+
+	cert_path, _ := ca.issue(t, t.TempDir(), "importer", 3, x509.ExtKeyUsageClientAuth)
+
+	data, err := ioutil.ReadFile(cert_path)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(data)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/v1/products", nil)
+
+	request.RemoteAddr = "203.0.113.7:40000"
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}
+
+	ctx := metadata.NewIncomingContext(context.Background(), GatewayMetadata(context.Background(), request))
+
+	require.Equal(t, "203.0.113.7", GatewayPeer(ctx))
+	require.Equal(t, "peer:203.0.113.7", RateLimitKey(ctx))
+
+	auth, err := NewAuthenticator(AuthConfig{ClientCerts: writeJSON(t, map[string]*CertSubject{"importer": {Roles: []string{ROLE_WRITER}}})})
+
+	require.NoError(t, err)
+
+	checked, err := auth.Check(ctx, MethodName("Fetch"))
+
+	require.NoError(t, err)
+	require.Equal(t, "importer", IdentityFromContext(checked).Name)
+
+	// anyone else sending the metadata is not believed
+	forged := GatewayMetadata(context.Background(), request)
+
+	forged.Set(GATEWAY_SECRET_METADATA_KEY, "guess")
+
+	ctx = metadata.NewIncomingContext(context.Background(), forged)
+
+	require.Empty(t, GatewayPeer(ctx))
+	require.Nil(t, ClientCertificate(ctx))
+
+	_, err = auth.Check(ctx, MethodName("Fetch"))
+
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGatewayServerTimeouts(t *testing.T) {
+	defer func(previous time.Duration) { list_timeout = previous }(list_timeout)
+
+	list_timeout = 15 * time.Second
+
+	gateway := NewGatewayServer("127.0.0.1:0", http.NotFoundHandler(), nil)
+
+	require.Equal(t, GATEWAY_READ_HEADER_TIMEOUT, gateway.ReadHeaderTimeout)
+	require.Equal(t, list_timeout, gateway.ReadTimeout)
+	require.Equal(t, GATEWAY_IDLE_TIMEOUT, gateway.IdleTimeout)
+
+	// imports and price change streams write for as long as they run
+	require.Zero(t, gateway.WriteTimeout)
+}
+
+func TestGatewayList(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	backend := grpc.NewServer(grpc.ChainUnaryInterceptor(RequestIdUnaryInterceptor))
+
+	api.RegisterApiServer(backend, &gatewayStub{})
+
+	go backend.Serve(listener)
+
+	defer backend.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	handler, err := NewGateway(context.Background(), conn)
+
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(handler)
+
+	defer ts.Close()
+
+	get := func(path string, headers map[string]string) *http.Response {
+		request, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+
+		require.NoError(t, err)
+
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+
+		require.NoError(t, err)
+
+		return response
+	}
+
+	response := get("/v1/products?sort=price&order=desc&page=2&per_page=5", map[string]string{"X-Api-Key": "secret", "Atlant-Tenant": "retail", "X-Request-Id": "abc-123"})
+
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "abc-123", response.Header.Get("X-Request-Id"))
+
+	var body map[string][]map[string]interface{}
+
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+	require.Len(t, body["results"], 1)
+
+	result := body["results"][0]
+
+	require.Equal(t, "price", result["product"])
+	require.Equal(t, float64(5), result["price"])
+	require.Equal(t, "2", result["timespricechanged"])
+	require.Equal(t, "1970-01-01T00:00:02Z", result["requesttime"])
+	require.Equal(t, "retail", result["import_id"])
+	require.Equal(t, "secret", result["source"])
+
+	response = get("/v1/products", nil)
+
+	response.Body.Close()
+
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response = get(OPENAPI_PATH, nil)
+
+	defer response.Body.Close()
+
+	document, err := ioutil.ReadAll(response.Body)
+
+	require.NoError(t, err)
+	require.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	require.Contains(t, string(document), `"/v1/products"`)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HEALTH_PORT     = 55556
+	DEFAULT_HEALTH_INTERVAL = 5 * time.Second
+
+	HEALTH_PATH = "/healthz"
+)
+
+var health_port = DEFAULT_HEALTH_PORT
+var health_interval = DEFAULT_HEALTH_INTERVAL
+
+var health_checker *HealthChecker
+
+// HealthChecker publishes whether this instance should get traffic over
+// grpc.health.v1 and plain HTTP. It is NOT_SERVING while MongoDB is
+// unreachable or the server is draining.
+type HealthChecker struct {
+	Server *health.Server
+	Ping   func(context.Context) error
+
+	mutex    sync.Mutex
+	store    error
+	draining bool
+}
+
+func NewHealthChecker(ping func(context.Context) error) *HealthChecker {
+	checker := &HealthChecker{Server: health.NewServer(), Ping: ping}
+
+	checker.publish()
+
+	return checker
+}
+
+// Run pings the store every interval until ctx is done
+func (c *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		c.CheckStore(ctx, interval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *HealthChecker) CheckStore(ctx context.Context, timeout time.Duration) {
+	ping_context, cancel := context.WithTimeout(ctx, timeout)
+
+	defer cancel()
+
+	err := c.Ping(ping_context)
+
+	c.mutex.Lock()
+
+	if (err == nil) != (c.store == nil) {
+		if err != nil {
+			slog.Warn("MongoDB is unreachable", "error", err)
+		} else {
+			slog.Info("MongoDB is reachable again")
+		}
+	}
+
+	c.store = err
+
+	c.mutex.Unlock()
+
+	c.publish()
+}
+
+// Drain reports NOT_SERVING for good, the load balancer stops sending new
+// calls while the running ones finish
+func (c *HealthChecker) Drain() {
+	c.mutex.Lock()
+	c.draining = true
+	c.mutex.Unlock()
+
+	c.publish()
+}
+
+// Status is SERVING only with a reachable store and while not draining
+func (c *HealthChecker) Status() healthpb.HealthCheckResponse_ServingStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.draining || c.store != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func (c *HealthChecker) publish() {
+	status := c.Status()
+
+	c.Server.SetServingStatus("", status)
+	c.Server.SetServingStatus(api.Api_ServiceDesc.ServiceName, status)
+}
+
+// ServeHTTP answers HAProxy checks: 200 when serving, 503 otherwise
+func (c *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := c.Status()
+
+	if status != healthpb.HealthCheckResponse_SERVING {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	fmt.Fprintln(w, status.String())
+}
+
+// HealthHandler serves HEALTH_PATH, main adds METRICS_PATH next to it
+func HealthHandler(checker *HealthChecker) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle(HEALTH_PATH, checker)
+
+	return mux
+}
+
+// PingMongo checks MongoDB is reachable. Unlike InitMongo it reports the
+// error instead of exiting.
+func PingMongo(ctx context.Context) error {
+	client, err := mongo.NewClient(options.Client().ApplyURI(MongoAddress()).SetMonitor(StoreMonitor))
+
+	if err != nil {
+		return err
+	}
+
+	err = client.Connect(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer client.Disconnect(ctx)
+
+	return client.Ping(ctx, nil)
+}
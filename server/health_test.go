@@ -0,0 +1,84 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var store_error error
+
+	checker := NewHealthChecker(func(context.Context) error {
+		return store_error
+	})
+
+	ts := httptest.NewServer(HealthHandler(checker))
+
+	defer ts.Close()
+
+	expect := func(expected healthpb.HealthCheckResponse_ServingStatus, code int) {
+		for _, service := range []string{"", api.Api_ServiceDesc.ServiceName} {
+			response, err := checker.Server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+
+			require.NoError(t, err)
+			require.Equal(t, expected, response.GetStatus(), service)
+		}
+
+		response, err := http.Get(ts.URL + HEALTH_PATH)
+
+		require.NoError(t, err)
+
+		response.Body.Close()
+
+		require.Equal(t, code, response.StatusCode)
+	}
+
+	expect(healthpb.HealthCheckResponse_SERVING, http.StatusOK)
+
+	store_error = errors.New("connection refused")
+
+	checker.CheckStore(context.Background(), time.Second)
+
+	expect(healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+
+	store_error = nil
+
+	checker.CheckStore(context.Background(), time.Second)
+
+	expect(healthpb.HealthCheckResponse_SERVING, http.StatusOK)
+
+	// draining wins over a healthy store
+	checker.Drain()
+	checker.CheckStore(context.Background(), time.Second)
+
+	expect(healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+}
+
+func TestHealthIsPublic(t *testing.T) {
+	defer func(previous *Authenticator) { authenticator = previous }(authenticator)
+
+	authenticator = &Authenticator{Rules: DefaultRules()}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	_, err := AuthUnaryInterceptor(incoming(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, handler)
+
+	require.NoError(t, err)
+
+	_, err = AuthUnaryInterceptor(incoming(), nil, &grpc.UnaryServerInfo{FullMethod: MethodName("List")}, handler)
+
+	require.Error(t, err)
+}
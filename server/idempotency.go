@@ -0,0 +1,116 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DB_REQUESTS_COLLECTION_NAME = "requests"
+
+	DEFAULT_IDEMPOTENCY_TTL = 24 * time.Hour
+
+	MAX_REQUEST_ID_LENGTH = 128
+
+	ERROR_REQUEST_ID_LENGTH = "Request id is too long"
+)
+
+var ErrRequestIdReused = errors.New("Request id was already used for another feed")
+
+var idempotency_ttl = DEFAULT_IDEMPOTENCY_TTL
+
+var db_requests_collection_name = DEFAULT_DB_REQUESTS_COLLECTION_NAME
+
+// request_indexes remembers the databases whose TTL index exists
+var request_indexes sync.Map
+
+// FetchOutcome is the recorded response of a Fetch carrying a request id.
+// A retry with the same id gets it back instead of importing the feed again.
+// Only successful imports are recorded, failed ones may be retried.
+type FetchOutcome struct {
+	RequestId   string `bson:"_id"`
+	Url         string
+	Count       int64
+	NotModified bool
+	ImportId    string
+	ExpiresAt   time.Time
+}
+
+func RequestsCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_requests_collection_name)
+}
+
+func CheckRequestId(request_id string) error {
+	if len(request_id) > MAX_REQUEST_ID_LENGTH {
+		return fmt.Errorf("%s: %d > %d", ERROR_REQUEST_ID_LENGTH, len(request_id), MAX_REQUEST_ID_LENGTH)
+	}
+
+	return nil
+}
+
+// LoadFetchOutcome returns the recorded response for the request, or nil
+// if there is none or it has expired.
+func LoadFetchOutcome(collection mongo.Collection, mng_context context.Context, in *api.FetchRequest) (*api.FetchResponse, error) {
+	var outcome FetchOutcome
+
+	filter := bson.M{"_id": in.GetRequestId(), "expiresat": bson.M{"$gt": time.Now()}}
+
+	err := collection.FindOne(mng_context, filter).Decode(&outcome)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if outcome.Url != in.GetUrl() {
+		return nil, fmt.Errorf("%w: %s", ErrRequestIdReused, outcome.Url)
+	}
+
+	return &api.FetchResponse{Count: outcome.Count, NotModified: outcome.NotModified, ImportId: outcome.ImportId}, nil
+}
+
+// SaveFetchOutcome records the response for ttl. Expired outcomes are
+// removed by a TTL index on expiresat.
+func SaveFetchOutcome(collection mongo.Collection, mng_context context.Context, in *api.FetchRequest, response *api.FetchResponse, ttl time.Duration) error {
+	database := collection.Database().Name()
+
+	if _, ok := request_indexes.Load(database); !ok {
+		index := mongo.IndexModel{
+			Keys:    bson.M{"expiresat": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}
+
+		if _, err := collection.Indexes().CreateOne(mng_context, index); err != nil {
+			return err
+		}
+
+		request_indexes.Store(database, true)
+	}
+
+	outcome := FetchOutcome{
+		RequestId:   in.GetRequestId(),
+		Url:         in.GetUrl(),
+		Count:       response.GetCount(),
+		NotModified: response.GetNotModified(),
+		ImportId:    response.GetImportId(),
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+
+	opts := options.Replace().SetUpsert(true)
+
+	_, err := collection.ReplaceOne(mng_context, bson.M{"_id": outcome.RequestId}, outcome, opts)
+
+	return err
+}
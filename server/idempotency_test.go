@@ -0,0 +1,69 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckRequestId(t *testing.T) {
+	require.NoError(t, CheckRequestId(""))
+	require.NoError(t, CheckRequestId("3f2a9c"))
+	require.Error(t, CheckRequestId(strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1)))
+}
+
+func TestFetchOutcome(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	collection := RequestsCollection(client, DEFAULT_TENANT)
+
+	in := &api.FetchRequest{Url: "https://example.com/test_outcome.csv", RequestId: "test-outcome"}
+
+	defer collection.DeleteOne(mng_context, bson.M{"_id": in.RequestId})
+
+	response, err := LoadFetchOutcome(collection, mng_context, in)
+
+	require.NoError(t, err)
+	require.Nil(t, response)
+
+	err = SaveFetchOutcome(collection, mng_context, in, &api.FetchResponse{Count: 7, ImportId: "job"}, time.Minute)
+
+	require.NoError(t, err)
+
+	response, err = LoadFetchOutcome(collection, mng_context, in)
+
+	require.NoError(t, err)
+	require.Equal(t, int64(7), response.GetCount())
+	require.Equal(t, "job", response.GetImportId())
+
+	// same key for another feed
+	_, err = LoadFetchOutcome(collection, mng_context, &api.FetchRequest{Url: "https://example.com/other.csv", RequestId: in.RequestId})
+
+	require.True(t, errors.Is(err, ErrRequestIdReused))
+
+	// expired but not yet removed by the TTL monitor
+	err = SaveFetchOutcome(collection, mng_context, in, &api.FetchResponse{Count: 7}, -time.Minute)
+
+	require.NoError(t, err)
+
+	response, err = LoadFetchOutcome(collection, mng_context, in)
+
+	require.NoError(t, err)
+	require.Nil(t, response)
+}
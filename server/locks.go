@@ -0,0 +1,147 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"golang.org/x/sync/singleflight"
+
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_DB_LOCKS_COLLECTION_NAME = "locks"
+
+	DEFAULT_LOCK_TTL = 60 * time.Second
+
+	ERROR_IMPORT_IN_PROGRESS = "Import of this feed is already in progress"
+	ERROR_IMPORT_CANCELLED   = "Import in progress was cancelled by the caller that started it"
+)
+
+var lock_ttl = DEFAULT_LOCK_TTL
+
+var db_locks_collection_name = DEFAULT_DB_LOCKS_COLLECTION_NAME
+
+// instance_id tells the lease owners apart, both backends share one Mongo
+var instance_id = InstanceId()
+
+// fetch_group coalesces identical Fetch calls arriving at this instance
+// while the first one is still running, they all get its result.
+var fetch_group singleflight.Group
+
+// Lock is a document in the locks collection, the holder renews it until
+// released. An expired lock may be taken over, so a crashed instance can't
+// block a feed for longer than lock_ttl.
+type Lock struct {
+	Key       string `bson:"_id"`
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// Lease is a lock held by this instance
+type Lease struct {
+	Key   string
+	Owner string
+
+	collection mongo.Collection
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func LocksCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_locks_collection_name)
+}
+
+func InstanceId() string {
+	hostname, _ := os.Hostname()
+
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.Int63())
+}
+
+// AcquireLease takes the lock for key or returns nil when somebody else
+// holds it. The lease is renewed in the background until Release.
+func AcquireLease(collection mongo.Collection, mng_context context.Context, key string, ttl time.Duration) (*Lease, error) {
+	now := time.Now()
+
+	lock := Lock{Key: key, Owner: instance_id, ExpiresAt: now.Add(ttl)}
+
+	_, err := collection.InsertOne(mng_context, lock)
+
+	if mongo.IsDuplicateKeyError(err) {
+		filter := bson.M{"_id": key, "expiresat": bson.M{"$lt": now}}
+		update := bson.M{"$set": bson.M{"owner": lock.Owner, "expiresat": lock.ExpiresAt}}
+
+		var result *mongo.UpdateResult
+
+		result, err = collection.UpdateOne(mng_context, filter, update)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result.ModifiedCount == 0 {
+			return nil, nil
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		Key:        key,
+		Owner:      lock.Owner,
+		collection: collection,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	go lease.renew(ttl)
+
+	return lease, nil
+}
+
+func (l *Lease) renew(ttl time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(ttl / 3)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			mng_context, cancel := context.WithTimeout(context.Background(), ttl/3)
+
+			filter := bson.M{"_id": l.Key, "owner": l.Owner}
+			update := bson.M{"$set": bson.M{"expiresat": time.Now().Add(ttl)}}
+
+			_, err := l.collection.UpdateOne(mng_context, filter, update)
+
+			cancel()
+
+			if err != nil {
+				slog.Warn("Cannot renew lock", "key", l.Key, "error", err)
+			}
+		}
+	}
+}
+
+// Release stops renewal and deletes the lock if it is still ours
+func (l *Lease) Release() error {
+	close(l.stop)
+	<-l.done
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := l.collection.DeleteOne(mng_context, bson.M{"_id": l.Key, "owner": l.Owner})
+
+	return err
+}
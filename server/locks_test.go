@@ -0,0 +1,202 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceFetch(t *testing.T) {
+	var runs int32
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	run := func() (*api.FetchResponse, error) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			close(started)
+		}
+
+		<-release
+
+		return &api.FetchResponse{Count: 42}, nil
+	}
+
+	in := &api.FetchRequest{Url: "https://example.com/coalesce.csv"}
+
+	var wg sync.WaitGroup
+
+	responses := make([]*api.FetchResponse, 5)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		responses[0], _ = CoalesceFetch(context.Background(), DEFAULT_TENANT, in, run)
+	}()
+
+	<-started
+
+	for i := 1; i < len(responses); i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			responses[i], _ = CoalesceFetch(context.Background(), DEFAULT_TENANT, in, run)
+		}(i)
+	}
+
+	// let the duplicates join the import in progress
+	time.Sleep(50 * time.Millisecond)
+
+	close(release)
+
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&runs))
+
+	for _, response := range responses {
+		require.Equal(t, int64(42), response.GetCount())
+	}
+
+	// a forced fetch is a different request
+	_, err := CoalesceFetch(context.Background(), DEFAULT_TENANT, &api.FetchRequest{Url: in.Url, Force: true}, run)
+
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&runs))
+
+	// so is the same feed for another catalogue
+	_, err = CoalesceFetch(context.Background(), "unit-b", in, run)
+
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&runs))
+}
+
+func TestCoalesceFetchFollowsCallerContext(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	run := func() (*api.FetchResponse, error) {
+		close(started)
+
+		<-release
+
+		return nil, status.Error(codes.Canceled, context.Canceled.Error())
+	}
+
+	in := &api.FetchRequest{Url: "https://example.com/coalesce-cancel.csv"}
+
+	leader := make(chan error)
+
+	go func() {
+		_, err := CoalesceFetch(context.Background(), DEFAULT_TENANT, in, run)
+
+		leader <- err
+	}()
+
+	<-started
+
+	// a caller giving up leaves at once
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+
+	defer cancel()
+
+	_, err := CoalesceFetch(ctx, DEFAULT_TENANT, in, run)
+
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// the others learn the import was cancelled by its starter and retry
+	follower := make(chan error)
+
+	go func() {
+		_, err := CoalesceFetch(context.Background(), DEFAULT_TENANT, in, run)
+
+		follower <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	close(release)
+
+	require.Equal(t, codes.Canceled, status.Code(<-leader))
+	require.Equal(t, codes.Aborted, status.Code(<-follower))
+}
+
+func TestAcquireLease(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	collection := LocksCollection(client, DEFAULT_TENANT)
+
+	key := "https://example.com/test_lock.csv"
+
+	defer collection.DeleteOne(mng_context, bson.M{"_id": key})
+
+	lease, err := AcquireLease(collection, mng_context, key, time.Minute)
+
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+
+	// somebody else holds it
+	other, err := AcquireLease(collection, mng_context, key, time.Minute)
+
+	require.NoError(t, err)
+	require.Nil(t, other)
+
+	require.NoError(t, lease.Release())
+
+	lease, err = AcquireLease(collection, mng_context, key, time.Minute)
+
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	require.NoError(t, lease.Release())
+}
+
+func TestAcquireExpiredLease(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	collection := LocksCollection(client, DEFAULT_TENANT)
+
+	key := "https://example.com/test_expired_lock.csv"
+
+	defer collection.DeleteOne(mng_context, bson.M{"_id": key})
+
+	// left behind by a crashed instance
+	_, err := collection.InsertOne(mng_context, Lock{Key: key, Owner: "crashed", ExpiresAt: time.Now().Add(-time.Second)})
+
+	require.NoError(t, err)
+
+	lease, err := AcquireLease(collection, mng_context, key, time.Minute)
+
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	require.NoError(t, lease.Release())
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel/trace"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// RPC_REQUEST_ID_METADATA_KEY carries the id of a single call, unlike
+	// FetchRequest.request_id which is shared by the retries of a fetch
+	RPC_REQUEST_ID_METADATA_KEY = "x-request-id"
+
+	DEFAULT_LOG_LEVEL = "info"
+	LOG_LEVEL_PATH    = "/loglevel"
+
+	ERROR_LOG_LEVEL = "Unknown log level"
+)
+
+var log_level_name = DEFAULT_LOG_LEVEL
+
+// log_level can be changed while the server runs with
+// log_level_updates, see LogLevelHandler
+var log_level = new(slog.LevelVar)
+var log_level_updates = false
+
+type rpcRequestIdKey struct{}
+
+// ContextHandler adds the request id of the call the context belongs to,
+// and its trace id when the call is traced, to every record logged with it
+type ContextHandler struct {
+	slog.Handler
+}
+
+func (h ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RpcRequestIdFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewLogger writes JSON lines at level and above to w
+func NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(ContextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+
+	err := level.UnmarshalText([]byte(strings.TrimSpace(name)))
+
+	if err != nil {
+		return level, fmt.Errorf("%s: %q", ERROR_LOG_LEVEL, name)
+	}
+
+	return level, nil
+}
+
+// SetupLogging makes JSON on stderr the default for slog and the log
+// package alike
+func SetupLogging(name string) error {
+	level, err := ParseLogLevel(name)
+
+	if err != nil {
+		return err
+	}
+
+	log_level.Set(level)
+
+	slog.SetDefault(NewLogger(os.Stderr, log_level))
+
+	return nil
+}
+
+// LogLevelHandler shows the log level on GET. With updates it changes it
+// on PUT with the level name as the body, e.g.
+// curl -X PUT -d debug 127.0.0.1:55558/loglevel
+func LogLevelHandler(level *slog.LevelVar, updates bool) http.Handler {
+	allow := "GET"
+
+	if updates {
+		allow = "GET, PUT"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+		case updates && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64))
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			parsed, err := ParseLogLevel(string(body))
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if parsed != level.Level() {
+				slog.Info("Log level changed", "from", level.Level().String(), "to", parsed.String())
+			}
+
+			level.Set(parsed)
+		default:
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintln(w, level.Level().String())
+	})
+}
+
+func NewRpcRequestId() string {
+	data := make([]byte, 16)
+
+	_, err := rand.Read(data)
+
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(data)
+}
+
+func WithRpcRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, rpcRequestIdKey{}, id)
+}
+
+func RpcRequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(rpcRequestIdKey{}).(string)
+
+	return id
+}
+
+// IncomingRpcRequestId takes the request id the client sent, or makes one
+// up when it is missing or unfit for logs
+func IncomingRpcRequestId(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(RPC_REQUEST_ID_METADATA_KEY)
+
+	if len(values) == 0 || !ValidRpcRequestId(values[0]) {
+		return NewRpcRequestId()
+	}
+
+	return values[0]
+}
+
+func ValidRpcRequestId(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logCall is the access log, one line per call once it is done
+func logCall(ctx context.Context, method string, started time.Time, err error) {
+	code := status.Code(err)
+
+	level := slog.LevelInfo
+
+	switch code {
+	case codes.OK:
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+
+	attrs := []interface{}{
+		"method", method,
+		"code", code.String(),
+		"duration_ms", time.Since(started).Milliseconds(),
+	}
+
+	if err != nil {
+		attrs = append(attrs, "error", status.Convert(err).Message())
+	}
+
+	slog.Log(ctx, level, "Call finished", attrs...)
+}
+
+func RequestIdUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := IncomingRpcRequestId(ctx)
+
+	ctx = WithRpcRequestId(ctx, id)
+
+	grpc.SetHeader(ctx, metadata.Pairs(RPC_REQUEST_ID_METADATA_KEY, id))
+
+	started := time.Now()
+
+	response, err := handler(ctx, req)
+
+	logCall(ctx, info.FullMethod, started, err)
+
+	return response, err
+}
+
+func RequestIdStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id := IncomingRpcRequestId(ss.Context())
+
+	ctx := WithRpcRequestId(ss.Context(), id)
+
+	ss.SetHeader(metadata.Pairs(RPC_REQUEST_ID_METADATA_KEY, id))
+
+	started := time.Now()
+
+	err := handler(srv, &contextStream{ss, ctx})
+
+	logCall(ctx, info.FullMethod, started, err)
+
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggerAddsRpcRequestId(t *testing.T) {
+	var buffer bytes.Buffer
+
+	logger := NewLogger(&buffer, slog.LevelInfo)
+
+	logger.InfoContext(WithRpcRequestId(context.Background(), "abc-123"), "Fetch", "url", "https://feeds.example.com/products.csv")
+	logger.DebugContext(context.Background(), "Not written")
+
+	var line map[string]interface{}
+
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &line))
+
+	require.Equal(t, "INFO", line["level"])
+	require.Equal(t, "Fetch", line["msg"])
+	require.Equal(t, "abc-123", line["request_id"])
+	require.Equal(t, "https://feeds.example.com/products.csv", line["url"])
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("debug")
+
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelDebug, level)
+
+	level, err = ParseLogLevel(" WARN\n")
+
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelWarn, level)
+
+	_, err = ParseLogLevel("loud")
+
+	require.Error(t, err)
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	level := new(slog.LevelVar)
+
+	ts := httptest.NewServer(LogLevelHandler(level, true))
+
+	defer ts.Close()
+
+	call := func(method string, body string) (int, string) {
+		request, err := http.NewRequest(method, ts.URL, strings.NewReader(body))
+
+		require.NoError(t, err)
+
+		response, err := http.DefaultClient.Do(request)
+
+		require.NoError(t, err)
+
+		defer response.Body.Close()
+
+		data, err := ioutil.ReadAll(response.Body)
+
+		require.NoError(t, err)
+
+		return response.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	code, body := call(http.MethodGet, "")
+
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "INFO", body)
+
+	code, body = call(http.MethodPut, "debug")
+
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "DEBUG", body)
+	require.Equal(t, slog.LevelDebug, level.Level())
+
+	code, _ = call(http.MethodPut, "loud")
+
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, slog.LevelDebug, level.Level())
+
+	code, _ = call(http.MethodDelete, "")
+
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// without updates the level can only be read
+	read_only := httptest.NewServer(LogLevelHandler(level, false))
+
+	defer read_only.Close()
+
+	request, err := http.NewRequest(http.MethodPut, read_only.URL, strings.NewReader("error"))
+
+	require.NoError(t, err)
+
+	response, err := http.DefaultClient.Do(request)
+
+	require.NoError(t, err)
+
+	response.Body.Close()
+
+	require.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+	require.Equal(t, "GET", response.Header.Get("Allow"))
+	require.Equal(t, slog.LevelDebug, level.Level())
+}
+
+func TestIncomingRpcRequestId(t *testing.T) {
+	incoming := func(md metadata.MD) string {
+		return IncomingRpcRequestId(metadata.NewIncomingContext(context.Background(), md))
+	}
+
+	require.Equal(t, "abc-123", incoming(metadata.Pairs(RPC_REQUEST_ID_METADATA_KEY, "abc-123")))
+
+	for _, md := range []metadata.MD{{}, metadata.Pairs(RPC_REQUEST_ID_METADATA_KEY, "with space"), metadata.Pairs(RPC_REQUEST_ID_METADATA_KEY, strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1))} {
+		id := incoming(md)
+
+		require.Len(t, id, 32)
+		require.True(t, ValidRpcRequestId(id))
+	}
+
+	require.NotEqual(t, incoming(metadata.MD{}), incoming(metadata.MD{}))
+}
+
+func TestRequestIdUnaryInterceptor(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(RPC_REQUEST_ID_METADATA_KEY, "abc-123"))
+
+	id, err := RequestIdUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/atlant.v1.Api/LogTest"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return RpcRequestIdFromContext(ctx), nil
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, "abc-123", id)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"go.mongodb.org/mongo-driver/event"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	METRICS_PATH      = "/metrics"
+	METRICS_NAMESPACE = "atlant"
+
+	RESULT_NOT_MODIFIED = "NotModified"
+
+	// SOURCE_ADHOC is the source label of imports a caller asked for, only
+	// subscriptions get one of their own
+	SOURCE_ADHOC = "adhoc"
+
+	// the admin endpoints are served apart from the health check HAProxy
+	// needs, on the loopback interface unless configured otherwise
+	DEFAULT_ADMIN_ADDRESS = "127.0.0.1"
+	DEFAULT_ADMIN_PORT    = 55558
+)
+
+var admin_address = DEFAULT_ADMIN_ADDRESS
+var admin_port = DEFAULT_ADMIN_PORT
+
+// metrics_registry holds our metrics next to the Go runtime and process
+// ones, apart from the global registry of the libraries we use
+var metrics_registry = NewMetricsRegistry()
+
+var metrics_factory = promauto.With(metrics_registry)
+
+var grpc_requests = metrics_factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "grpc_requests_total",
+	Help:      "gRPC calls handled, by method and status code.",
+}, []string{"method", "code"})
+
+var grpc_duration = metrics_factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "grpc_request_duration_seconds",
+	Help:      "Time spent handling gRPC calls.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"method"})
+
+var import_duration = metrics_factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "import_duration_seconds",
+	Help:      "Time spent importing a feed, download included, by result.",
+	Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+}, []string{"source", "result"})
+
+var active_imports = metrics_factory.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "active_imports",
+	Help:      "Imports running on this instance.",
+}, []string{"source"})
+
+var rows_processed = metrics_factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "import_rows_processed_total",
+	Help:      "Feed rows read.",
+}, []string{"source"})
+
+var rows_changed = metrics_factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "import_rows_changed_total",
+	Help:      "Feed rows that added a product or changed its price.",
+}, []string{"source"})
+
+var rows_rejected = metrics_factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "import_rows_rejected_total",
+	Help:      "Feed rows with a wrong structure or price.",
+}, []string{"source"})
+
+var download_bytes = metrics_factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "download_bytes_total",
+	Help:      "Feed bytes downloaded, before decompression.",
+}, []string{"source"})
+
+var webhook_deliveries = metrics_factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "webhook_deliveries_total",
+	Help:      "Webhook delivery attempts, by result: delivered, retry or dead.",
+}, []string{"result"})
+
+var store_duration = metrics_factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: METRICS_NAMESPACE,
+	Name:      "store_operation_duration_seconds",
+	Help:      "Time spent in MongoDB commands, by command and result.",
+	Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+}, []string{"operation", "result"})
+
+func NewMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	return registry
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics_registry, promhttp.HandlerOpts{})
+}
+
+// AdminHandler serves the metrics and the log level, debug logs name the
+// feeds
+func AdminHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle(METRICS_PATH, MetricsHandler())
+	mux.Handle(LOG_LEVEL_PATH, LogLevelHandler(log_level, log_level_updates))
+
+	return mux
+}
+
+type subscriptionKey struct{}
+
+// WithSubscription marks ctx as the scheduled run of subscription id
+func WithSubscription(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, subscriptionKey{}, id)
+}
+
+// MetricsSource is the source label of the import running under ctx: the
+// subscription id for scheduled runs and SOURCE_ADHOC for the others. Feed
+// URLs come from callers, a label per URL would grow without bound.
+func MetricsSource(ctx context.Context) string {
+	if id, ok := ctx.Value(subscriptionKey{}).(string); ok {
+		return id
+	}
+
+	return SOURCE_ADHOC
+}
+
+// SourceLabel is the feed URL without credentials, query and fragment, which
+// may carry signatures or tokens, for logs and traces
+func SourceLabel(raw_url string) string {
+	feed_url, err := url.Parse(raw_url)
+
+	if err != nil {
+		return "invalid"
+	}
+
+	feed_url.User = nil
+	feed_url.RawQuery = ""
+	feed_url.Fragment = ""
+
+	return feed_url.String()
+}
+
+// ObserveImport runs the import of ctx and records how long it took and how
+// it ended
+func ObserveImport(ctx context.Context, run func() (*api.FetchResponse, error)) (*api.FetchResponse, error) {
+	label := MetricsSource(ctx)
+
+	active_imports.WithLabelValues(label).Inc()
+
+	defer active_imports.WithLabelValues(label).Dec()
+
+	started := time.Now()
+
+	response, err := run()
+
+	result := status.Code(err).String()
+
+	if err == nil && response.GetNotModified() {
+		result = RESULT_NOT_MODIFIED
+	}
+
+	import_duration.WithLabelValues(label, result).Observe(time.Since(started).Seconds())
+
+	return response, err
+}
+
+// StoreMonitor times every MongoDB command sent by our clients
+var StoreMonitor = &event.CommandMonitor{
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		store_duration.WithLabelValues(e.CommandName, "ok").Observe(time.Duration(e.DurationNanos).Seconds())
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		store_duration.WithLabelValues(e.CommandName, "error").Observe(time.Duration(e.DurationNanos).Seconds())
+	},
+}
+
+func observeCall(method string, started time.Time, err error) {
+	grpc_requests.WithLabelValues(method, status.Code(err).String()).Inc()
+	grpc_duration.WithLabelValues(method).Observe(time.Since(started).Seconds())
+}
+
+func MetricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	started := time.Now()
+
+	response, err := handler(ctx, req)
+
+	observeCall(info.FullMethod, started, err)
+
+	return response, err
+}
+
+func MetricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	started := time.Now()
+
+	err := handler(srv, ss)
+
+	observeCall(info.FullMethod, started, err)
+
+	return err
+}
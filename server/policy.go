@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+const (
+	DEFAULT_ALLOWED_SCHEMES = "http,https"
+
+	// loopback, private, link-local (cloud metadata lives at 169.254.169.254),
+	// carrier-grade NAT, benchmarking, multicast and reserved ranges
+	DEFAULT_BLOCKED_NETWORKS = "0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12," +
+		"192.0.0.0/24,192.168.0.0/16,198.18.0.0/15,224.0.0.0/4,240.0.0.0/4," +
+		"::/128,::1/128,64:ff9b::/96,fc00::/7,fe80::/10,ff00::/8"
+
+	ERROR_FORBIDDEN_SCHEME  = "URL scheme is not allowed"
+	ERROR_FORBIDDEN_HOST    = "Host is not allowed"
+	ERROR_FORBIDDEN_ADDRESS = "Address is not allowed"
+)
+
+var allowed_schemes = DEFAULT_ALLOWED_SCHEMES
+var allowed_hosts = ""
+var denied_hosts = ""
+var blocked_networks = DEFAULT_BLOCKED_NETWORKS
+
+// url_policy is rebuilt by main once flags are parsed
+var url_policy = MustURLPolicy(allowed_schemes, allowed_hosts, denied_hosts, blocked_networks)
+
+// URLPolicy decides which feed URLs the server may download. Scheme and host
+// rules are checked against the URL and every redirect, network rules against
+// the resolved address right before connecting, so DNS rebinding can't sneak
+// an internal address past the check.
+type URLPolicy struct {
+	Schemes         []string
+	AllowedHosts    []string
+	DeniedHosts     []string
+	BlockedNetworks []*net.IPNet
+}
+
+// PolicyError is returned when a URL or address is rejected by URLPolicy
+type PolicyError struct {
+	Reason string
+	Value  string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Value)
+}
+
+// NewURLPolicy builds a policy from comma separated lists. Empty allowed
+// hosts means any host; "*.example.com" matches subdomains of example.com.
+func NewURLPolicy(schemes string, allowed string, denied string, networks string) (*URLPolicy, error) {
+	policy := &URLPolicy{
+		Schemes:      SplitList(strings.ToLower(schemes)),
+		AllowedHosts: SplitList(strings.ToLower(allowed)),
+		DeniedHosts:  SplitList(strings.ToLower(denied)),
+	}
+
+	blocked, err := ParseNetworks(networks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	policy.BlockedNetworks = blocked
+
+	return policy, nil
+}
+
+func MustURLPolicy(schemes string, allowed string, denied string, networks string) *URLPolicy {
+	policy, err := NewURLPolicy(schemes, allowed, denied, networks)
+
+	ErrorCheck(err)
+
+	return policy
+}
+
+func (p *URLPolicy) CheckURL(feed_url *url.URL) error {
+	if !p.SchemeAllowed(feed_url.Scheme) {
+		return &PolicyError{ERROR_FORBIDDEN_SCHEME, feed_url.Scheme}
+	}
+
+	host := NormalizeHost(feed_url.Hostname())
+
+	if !p.HostAllowed(host) {
+		return &PolicyError{ERROR_FORBIDDEN_HOST, host}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	return nil
+}
+
+func (p *URLPolicy) SchemeAllowed(scheme string) bool {
+	for _, allowed := range p.Schemes {
+		if strings.EqualFold(allowed, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *URLPolicy) HostAllowed(host string) bool {
+	for _, pattern := range p.DeniedHosts {
+		if MatchHost(pattern, host) {
+			return false
+		}
+	}
+
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.AllowedHosts {
+		if MatchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *URLPolicy) CheckIP(ip net.IP) error {
+	if ContainsIP(p.BlockedNetworks, ip) {
+		return &PolicyError{ERROR_FORBIDDEN_ADDRESS, ip.String()}
+	}
+
+	return nil
+}
+
+// Control is a net.Dialer hook, address is always a resolved IP and port
+func (p *URLPolicy) Control(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return &PolicyError{ERROR_FORBIDDEN_ADDRESS, address}
+	}
+
+	return p.CheckIP(ip)
+}
+
+// NormalizeHost lower-cases host and drops the trailing dot of a fully
+// qualified name, DNS resolves both spellings to the same address
+func NormalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func MatchHost(pattern string, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return pattern == host
+}
+
+// ParseNetworks parses a comma separated list of CIDR ranges
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range SplitList(list) {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func SplitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func checkURL(t *testing.T, policy *URLPolicy, raw string) error {
+	feed_url, err := url.Parse(raw)
+	require.NoError(t, err)
+
+	return policy.CheckURL(feed_url)
+}
+
+func TestURLPolicySchemes(t *testing.T) {
+	policy := MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", DEFAULT_BLOCKED_NETWORKS)
+
+	require.NoError(t, checkURL(t, policy, "https://example.com/products.csv"))
+	require.NoError(t, checkURL(t, policy, "HTTP://example.com/products.csv"))
+	require.Error(t, checkURL(t, policy, "ftp://example.com/products.csv"))
+	require.Error(t, checkURL(t, policy, "file:///etc/passwd"))
+}
+
+func TestURLPolicyHosts(t *testing.T) {
+	policy := MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "feeds.example.com, *.supplier.org", "bad.supplier.org", "")
+
+	require.NoError(t, checkURL(t, policy, "https://feeds.example.com/products.csv"))
+	require.NoError(t, checkURL(t, policy, "https://eu.supplier.org/products.csv"))
+	require.Error(t, checkURL(t, policy, "https://supplier.org/products.csv"))
+	require.Error(t, checkURL(t, policy, "https://bad.supplier.org/products.csv"))
+	require.Error(t, checkURL(t, policy, "https://bad.supplier.org./products.csv"))
+	require.NoError(t, checkURL(t, policy, "https://eu.supplier.org./products.csv"))
+	require.Error(t, checkURL(t, policy, "https://example.com/products.csv"))
+}
+
+func TestURLPolicyBlocksPrivateAddresses(t *testing.T) {
+	policy := MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", DEFAULT_BLOCKED_NETWORKS)
+
+	for _, address := range []string{"127.0.0.1", "10.1.2.3", "172.20.0.5", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:10.0.0.1"} {
+		require.Error(t, policy.CheckIP(net.ParseIP(address)), address)
+	}
+
+	for _, address := range []string{"8.8.8.8", "140.82.112.3", "2606:4700::1111"} {
+		require.NoError(t, policy.CheckIP(net.ParseIP(address)), address)
+	}
+
+	require.Error(t, checkURL(t, policy, "http://169.254.169.254/latest/meta-data/"))
+	require.Error(t, checkURL(t, policy, "http://[::1]:8080/"))
+}
+
+func TestURLPolicyRejectsInvalidNetworks(t *testing.T) {
+	_, err := NewURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", "10.0.0.0/33")
+
+	require.Error(t, err)
+}
+
+func TestFetcherChecksAddressAtDialTime(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PRODUCT NAME;PRICE\n"))
+	}))
+
+	defer ts.Close()
+
+	// a host name passes the URL check and only resolves to loopback later
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", DEFAULT_BLOCKED_NETWORKS))
+
+	_, _, err = fetcher.Get(context.Background(), "http://localhost:"+port+"/", nil)
+
+	var policy_error *PolicyError
+
+	require.True(t, errors.As(err, &policy_error), "%v", err)
+	require.False(t, Retryable(err))
+	require.Equal(t, codes.PermissionDenied, DownloadErrorCode(err))
+}
+
+func TestFetcherChecksRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://example.com/products.csv", http.StatusFound)
+	}))
+
+	defer ts.Close()
+
+	_, _, err := testFetcher().Get(context.Background(), ts.URL, nil)
+
+	require.Error(t, err)
+	require.Equal(t, codes.PermissionDenied, DownloadErrorCode(err))
+}
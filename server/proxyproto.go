@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// PROXY_HEADER_TIMEOUT bounds the wait for the header of a proxied
+	// connection
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+	PROXY_COMMAND_LOCAL = 0x0
+	PROXY_COMMAND_PROXY = 0x1
+
+	PROXY_FAMILY_TCP4 = 0x11
+	PROXY_FAMILY_TCP6 = 0x21
+
+	ERROR_PROXY_HEADER = "Invalid PROXY protocol header"
+)
+
+// PROXY_SIGNATURE starts every PROXY protocol v2 header
+var PROXY_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var proxy_networks = ""
+
+// ProxyListener reads the PROXY protocol v2 header HAProxy sends with
+// send-proxy-v2, so callers behind it keep their own address. Only
+// connections from Trusted networks carry the header, anyone else could
+// claim any address with it.
+type ProxyListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+func NewProxyListener(listener net.Listener, networks string) (net.Listener, error) {
+	trusted, err := ParseNetworks(networks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(trusted) == 0 {
+		return listener, nil
+	}
+
+	return &ProxyListener{Listener: listener, Trusted: trusted}, nil
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tcp_address, ok := conn.RemoteAddr().(*net.TCPAddr); ok && ContainsIP(l.Trusted, tcp_address.IP) {
+		return &ProxyConn{Conn: conn}, nil
+	}
+
+	return conn, nil
+}
+
+// ProxyConn reads the header on first use rather than in Accept, which
+// must not wait for a slow peer. The header gets PROXY_HEADER_TIMEOUT, the
+// read deadline its user set is kept for what follows.
+type ProxyConn struct {
+	net.Conn
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	mutex    sync.Mutex
+	reading  bool
+	deadline time.Time
+}
+
+func (c *ProxyConn) readHeader() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+
+		c.mutex.Lock()
+
+		c.reading = true
+
+		deadline := time.Now().Add(PROXY_HEADER_TIMEOUT)
+
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+
+		c.Conn.SetReadDeadline(deadline)
+
+		c.mutex.Unlock()
+
+		defer func() {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+
+			c.reading = false
+
+			c.Conn.SetReadDeadline(c.deadline)
+		}()
+
+		remote, err := ReadProxyHeader(c.Conn)
+
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+// SetDeadline and SetReadDeadline remember the read deadline, while the
+// header is read it only takes effect once the header is done
+func (c *ProxyConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deadline = t
+
+	if c.reading {
+		return c.Conn.SetWriteDeadline(t)
+	}
+
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *ProxyConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deadline = t
+
+	if c.reading {
+		return nil
+	}
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+
+	return c.remote
+}
+
+// ReadProxyHeader consumes a PROXY protocol v2 header and returns the
+// source address it carries, nil for health checks and non TCP traffic
+func ReadProxyHeader(reader io.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("%s: %v", ERROR_PROXY_HEADER, err)
+	}
+
+	if !bytes.Equal(header[:12], PROXY_SIGNATURE) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%s: bad signature", ERROR_PROXY_HEADER)
+	}
+
+	command := header[12] & 0x0f
+	family := header[13]
+
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, fmt.Errorf("%s: %v", ERROR_PROXY_HEADER, err)
+	}
+
+	if command == PROXY_COMMAND_LOCAL {
+		return nil, nil
+	}
+
+	if command != PROXY_COMMAND_PROXY {
+		return nil, fmt.Errorf("%s: command %d", ERROR_PROXY_HEADER, command)
+	}
+
+	size := 0
+
+	switch family {
+	case PROXY_FAMILY_TCP4:
+		size = net.IPv4len
+	case PROXY_FAMILY_TCP6:
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+
+	// source and destination addresses, then their ports
+	if len(addresses) < 2*size+4 {
+		return nil, fmt.Errorf("%s: short address block", ERROR_PROXY_HEADER)
+	}
+
+	ip := net.IP(addresses[:size])
+	port := binary.BigEndian.Uint16(addresses[2*size : 2*size+2])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func proxyHeader(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, PROXY_SIGNATURE...)
+	header = append(header, 0x20|command, family, 0, 0)
+
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+
+	return append(header, addresses...)
+}
+
+func tcp4Addresses(source string, port uint16) []byte {
+	addresses := append(net.ParseIP(source).To4(), net.ParseIP("10.0.0.1").To4()...)
+
+	return append(addresses, byte(port>>8), byte(port), 0xd9, 0x03)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	remote, err := ReadProxyHeader(bytes.NewReader(proxyHeader(PROXY_COMMAND_PROXY, PROXY_FAMILY_TCP4, tcp4Addresses("203.0.113.7", 40000))))
+
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7:40000", remote.String())
+
+	addresses := append(append(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1")...), 0x9c, 0x40, 0xd9, 0x03)
+
+	remote, err = ReadProxyHeader(bytes.NewReader(proxyHeader(PROXY_COMMAND_PROXY, PROXY_FAMILY_TCP6, addresses)))
+
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::7]:40000", remote.String())
+
+	// health checks of the proxy itself keep the connection's address
+	remote, err = ReadProxyHeader(bytes.NewReader(proxyHeader(PROXY_COMMAND_LOCAL, 0, nil)))
+
+	require.NoError(t, err)
+	require.Nil(t, remote)
+
+	_, err = ReadProxyHeader(bytes.NewReader([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")))
+
+	require.ErrorContains(t, err, ERROR_PROXY_HEADER)
+
+	_, err = ReadProxyHeader(bytes.NewReader(proxyHeader(PROXY_COMMAND_PROXY, PROXY_FAMILY_TCP4, []byte{1, 2})))
+
+	require.ErrorContains(t, err, ERROR_PROXY_HEADER)
+}
+
+func TestProxyListener(t *testing.T) {
+	dial := func(listener net.Listener, payload []byte) net.Conn {
+		client, err := net.Dial("tcp", listener.Addr().String())
+
+		require.NoError(t, err)
+
+		_, err = client.Write(payload)
+
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		return conn
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	listener, err := NewProxyListener(lis, "127.0.0.0/8")
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	payload := append(proxyHeader(PROXY_COMMAND_PROXY, PROXY_FAMILY_TCP4, tcp4Addresses("203.0.113.7", 40000)), "hello"...)
+
+	conn := dial(listener, payload)
+
+	require.Equal(t, "203.0.113.7:40000", conn.RemoteAddr().String())
+
+	body, err := ioutil.ReadAll(conn)
+
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+
+	// connections from elsewhere are passed through untouched
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	listener, err = NewProxyListener(lis, "10.0.0.0/8")
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	conn = dial(listener, payload)
+
+	require.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+
+	body, err = ioutil.ReadAll(conn)
+
+	require.NoError(t, err)
+	require.Equal(t, payload, body)
+
+	_, err = NewProxyListener(lis, "haproxy")
+
+	require.Error(t, err)
+}
+
+func TestProxyConnKeepsDeadline(t *testing.T) {
+	client, server := net.Pipe()
+
+	defer client.Close()
+
+	conn := &ProxyConn{Conn: server}
+
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+
+	go client.Write(proxyHeader(PROXY_COMMAND_PROXY, PROXY_FAMILY_TCP4, tcp4Addresses("203.0.113.7", 40000)))
+
+	require.Equal(t, "203.0.113.7:40000", conn.RemoteAddr().String())
+
+	// nothing follows the header, the read gives up at the caller's deadline
+	_, err := conn.Read(make([]byte, 1))
+
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
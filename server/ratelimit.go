@@ -0,0 +1,239 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FETCH_RATE             = 0.2
+	DEFAULT_FETCH_BURST            = 5
+	DEFAULT_LIST_RATE              = 20
+	DEFAULT_LIST_BURST             = 40
+	DEFAULT_MAX_CONCURRENT_IMPORTS = 8
+
+	// IMPORT_RETRY_DELAY is suggested to callers when all import slots are busy
+	IMPORT_RETRY_DELAY = 5 * time.Second
+
+	// LIMITER_IDLE_TIMEOUT is how long an unused bucket is kept
+	LIMITER_IDLE_TIMEOUT = 10 * time.Minute
+
+	ERROR_RATE_LIMITED = "Rate limit exceeded"
+	ERROR_IMPORTS_BUSY = "Too many imports in progress"
+)
+
+var fetch_rate float64 = DEFAULT_FETCH_RATE
+var fetch_burst = DEFAULT_FETCH_BURST
+var list_rate float64 = DEFAULT_LIST_RATE
+var list_burst = DEFAULT_LIST_BURST
+var max_concurrent_imports = DEFAULT_MAX_CONCURRENT_IMPORTS
+
+var fetch_limiter *RateLimiter
+var list_limiter *RateLimiter
+var import_slots *ImportSlots
+
+// RateLimiter keeps a token bucket per caller. A zero rate disables it.
+type RateLimiter struct {
+	Rate  rate.Limit
+	Burst int
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+func NewRateLimiter(per_second float64, burst int) *RateLimiter {
+	if per_second <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		Rate:    rate.Limit(per_second),
+		Burst:   burst,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the bucket of key. When there is none it returns
+// false and how long to wait for the next one.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.swept) > LIMITER_IDLE_TIMEOUT {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.Rate, l.Burst)}
+		l.buckets[key] = b
+	}
+
+	b.used = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+
+	delay := reservation.DelayFrom(now)
+
+	if delay == 0 {
+		return true, 0
+	}
+
+	reservation.CancelAt(now)
+
+	return false, delay
+}
+
+// sweep forgets idle buckets, they are full again by now anyway
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.used) > LIMITER_IDLE_TIMEOUT {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.swept = now
+}
+
+// ImportSlots caps the imports running on this instance at once, scheduled
+// ones included. A nil ImportSlots is unlimited.
+type ImportSlots struct {
+	slots chan struct{}
+}
+
+func NewImportSlots(size int) *ImportSlots {
+	if size <= 0 {
+		return nil
+	}
+
+	return &ImportSlots{slots: make(chan struct{}, size)}
+}
+
+// Acquire takes a slot without waiting, release it with Release
+func (s *ImportSlots) Acquire() error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+		return Exhausted(ERROR_IMPORTS_BUSY, IMPORT_RETRY_DELAY)
+	}
+}
+
+func (s *ImportSlots) Release() {
+	if s != nil {
+		<-s.slots
+	}
+}
+
+// Exhausted is a ResourceExhausted status telling the caller when to retry
+func Exhausted(message string, delay time.Duration) error {
+	seconds := int64(math.Ceil(delay.Seconds()))
+
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("%s, retry in %ds", message, seconds))
+
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// RateLimitKey identifies the caller: its authenticated name or, without
+// authentication, its address, the HTTP caller's one for gateway calls.
+func RateLimitKey(ctx context.Context) string {
+	if identity := IdentityFromContext(ctx); identity != nil {
+		return identity.Method + ":" + identity.Name
+	}
+
+	if address := GatewayPeer(ctx); address != "" {
+		return "peer:" + address
+	}
+
+	if caller, ok := peer.FromContext(ctx); ok && caller.Addr != nil {
+		host, _, err := net.SplitHostPort(caller.Addr.String())
+
+		if err != nil {
+			return "peer:" + caller.Addr.String()
+		}
+
+		return "peer:" + host
+	}
+
+	return "unknown"
+}
+
+// LimiterFor picks the budget of a method: Fetch has its own, List and all
+// the other calls share one.
+func LimiterFor(method string) *RateLimiter {
+	if method == MethodName("Fetch") {
+		return fetch_limiter
+	}
+
+	return list_limiter
+}
+
+func CheckRateLimit(ctx context.Context, method string) error {
+	limiter := LimiterFor(method)
+
+	if limiter == nil || PublicMethod(method) {
+		return nil
+	}
+
+	allowed, delay := limiter.Allow(RateLimitKey(ctx), time.Now())
+
+	if !allowed {
+		return Exhausted(ERROR_RATE_LIMITED, delay)
+	}
+
+	return nil
+}
+
+func RateLimitUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	err := CheckRateLimit(ctx, info.FullMethod)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func RateLimitStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := CheckRateLimit(ss.Context(), info.FullMethod)
+
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
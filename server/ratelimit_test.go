@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := limiter.Allow("importer", now)
+
+		require.True(t, allowed)
+	}
+
+	allowed, delay := limiter.Allow("importer", now)
+
+	require.False(t, allowed)
+	require.InDelta(t, time.Second, delay, float64(10*time.Millisecond))
+
+	// other callers have their own bucket
+	allowed, _ = limiter.Allow("dashboard", now)
+
+	require.True(t, allowed)
+
+	allowed, _ = limiter.Allow("importer", now.Add(time.Second))
+
+	require.True(t, allowed)
+
+	// idle buckets are forgotten
+	limiter.Allow("dashboard", now.Add(2*LIMITER_IDLE_TIMEOUT))
+
+	require.Len(t, limiter.buckets, 1)
+
+	require.Nil(t, NewRateLimiter(0, 10))
+}
+
+func TestExhaustedCarriesRetryDelay(t *testing.T) {
+	err := Exhausted(ERROR_RATE_LIMITED, 1500*time.Millisecond)
+
+	st := status.Convert(err)
+
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Contains(t, st.Message(), "retry in 2s")
+
+	require.Len(t, st.Details(), 1)
+
+	info, ok := st.Details()[0].(*errdetails.RetryInfo)
+
+	require.True(t, ok)
+	require.Equal(t, 1500*time.Millisecond, info.GetRetryDelay().AsDuration())
+}
+
+func TestImportSlots(t *testing.T) {
+	slots := NewImportSlots(2)
+
+	require.NoError(t, slots.Acquire())
+	require.NoError(t, slots.Acquire())
+
+	err := slots.Acquire()
+
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	slots.Release()
+
+	require.NoError(t, slots.Acquire())
+
+	var unlimited *ImportSlots
+
+	require.NoError(t, unlimited.Acquire())
+
+	unlimited.Release()
+}
+
+func TestRateLimitKey(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 41000}})
+
+	require.Equal(t, "peer:10.0.0.7", RateLimitKey(ctx))
+
+	ctx = WithIdentity(ctx, &Identity{Name: "importer", Method: "api_key"})
+
+	require.Equal(t, "api_key:importer", RateLimitKey(ctx))
+}
+
+func TestRateLimitInterceptorBudgets(t *testing.T) {
+	defer func(fetch, list *RateLimiter) {
+		fetch_limiter, list_limiter = fetch, list
+	}(fetch_limiter, list_limiter)
+
+	fetch_limiter = NewRateLimiter(0.01, 1)
+	list_limiter = NewRateLimiter(100, 100)
+
+	ctx := WithIdentity(context.Background(), &Identity{Name: "importer", Method: "api_key"})
+
+	call := func(method string) error {
+		_, err := RateLimitUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: MethodName(method)}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+
+		return err
+	}
+
+	require.NoError(t, call("Fetch"))
+	require.Equal(t, codes.ResourceExhausted, status.Code(call("Fetch")))
+
+	// an exhausted Fetch budget doesn't stop listing
+	require.NoError(t, call("List"))
+}
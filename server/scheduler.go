@@ -0,0 +1,453 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/robfig/cron/v3"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+const (
+	DEFAULT_DB_SUBSCRIPTIONS_COLLECTION_NAME = "subscriptions"
+
+	DEFAULT_SCHEDULER_INTERVAL = 30 * time.Second
+	DEFAULT_MIN_INTERVAL       = 60 * time.Second
+
+	ERROR_SUBSCRIPTION_URL      = "Subscription URL is required"
+	ERROR_SUBSCRIPTION_SCHEDULE = "Subscription needs either cron or interval"
+	ERROR_SUBSCRIPTION_INTERVAL = "Subscription interval is too short"
+	ERROR_SUBSCRIPTION_CRON     = "Incorrect cron expression"
+	ERROR_SUBSCRIPTION_ID       = "Incorrect subscription id"
+	ERROR_SUBSCRIPTION_MISSING  = "Subscription not found"
+)
+
+var scheduler_interval = DEFAULT_SCHEDULER_INTERVAL
+var min_interval = DEFAULT_MIN_INTERVAL
+
+var db_subscriptions_collection_name = DEFAULT_DB_SUBSCRIPTIONS_COLLECTION_NAME
+
+// Subscription is a feed the server imports on its own, either on a cron
+// schedule or every Interval seconds. It is imported like a Fetch, in the
+// one CSV dialect and upsert mode the importer has.
+type Subscription struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	Url        string
+	Cron       string
+	Interval   int64
+	Credential string
+	Force      bool
+	NextRun    int64
+	LastRun    int64
+	LastCount  int64
+	LastError  string
+
+	// Tenant is the catalogue whose database the subscription is stored in
+	Tenant string `bson:"-"`
+}
+
+func SubscriptionsCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_subscriptions_collection_name)
+}
+
+func (s *server) CreateSubscription(ctx context.Context, in *api.Subscription) (*api.Subscription, error) {
+	subscription, err := SubscriptionFromApi(in)
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	subscription.Id = primitive.NewObjectID()
+	subscription.NextRun = NextRun(subscription, time.Now())
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	collection := SubscriptionsCollection(client, TenantFromContext(ctx))
+
+	_, err = collection.InsertOne(ctx, subscription)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	slog.InfoContext(ctx, "Subscription created", "subscription", subscription.Id.Hex(), "url", subscription.Url)
+
+	return SubscriptionToApi(subscription), nil
+}
+
+func (s *server) UpdateSubscription(ctx context.Context, in *api.Subscription) (*api.Subscription, error) {
+	subscription, err := SubscriptionFromApi(in)
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	id, err := primitive.ObjectIDFromHex(in.GetId())
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", ERROR_SUBSCRIPTION_ID, in.GetId())
+	}
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	collection := SubscriptionsCollection(client, TenantFromContext(ctx))
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "url", Value: subscription.Url},
+			{Key: "cron", Value: subscription.Cron},
+			{Key: "interval", Value: subscription.Interval},
+			{Key: "credential", Value: subscription.Credential},
+			{Key: "force", Value: subscription.Force},
+			{Key: "nextrun", Value: NextRun(subscription, time.Now())},
+		}},
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	if result.MatchedCount == 0 {
+		return nil, status.Errorf(codes.NotFound, "%s: %s", ERROR_SUBSCRIPTION_MISSING, in.GetId())
+	}
+
+	err = collection.FindOne(ctx, bson.M{"_id": id}).Decode(&subscription)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	return SubscriptionToApi(subscription), nil
+}
+
+func (s *server) DeleteSubscription(ctx context.Context, in *api.DeleteSubscriptionRequest) (*api.DeleteSubscriptionResponse, error) {
+	id, err := primitive.ObjectIDFromHex(in.GetId())
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", ERROR_SUBSCRIPTION_ID, in.GetId())
+	}
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	collection := SubscriptionsCollection(client, TenantFromContext(ctx))
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	if result.DeletedCount == 0 {
+		return nil, status.Errorf(codes.NotFound, "%s: %s", ERROR_SUBSCRIPTION_MISSING, in.GetId())
+	}
+
+	slog.InfoContext(ctx, "Subscription deleted", "subscription", in.GetId())
+
+	return &api.DeleteSubscriptionResponse{}, nil
+}
+
+func (s *server) ListSubscriptions(ctx context.Context, in *api.ListSubscriptionsRequest) (*api.ListSubscriptionsResponse, error) {
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	collection := SubscriptionsCollection(client, TenantFromContext(ctx))
+
+	cursor, err := collection.Find(ctx, bson.D{})
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	var subscriptions []Subscription
+
+	err = cursor.All(ctx, &subscriptions)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	data := make([]*api.Subscription, len(subscriptions))
+
+	for i := range subscriptions {
+		data[i] = SubscriptionToApi(subscriptions[i])
+	}
+
+	return &api.ListSubscriptionsResponse{Subscriptions: data}, nil
+}
+
+// SubscriptionFromApi validates a subscription coming from a client, output
+// only fields such as NextRun or LastError are ignored.
+func SubscriptionFromApi(in *api.Subscription) (Subscription, error) {
+	subscription := Subscription{
+		Url:        in.GetUrl(),
+		Cron:       in.GetCron(),
+		Interval:   in.GetInterval(),
+		Credential: in.GetCredential(),
+		Force:      in.GetForce(),
+	}
+
+	if subscription.Url == "" {
+		return subscription, fmt.Errorf("%s", ERROR_SUBSCRIPTION_URL)
+	}
+
+	feed_url, err := url.Parse(subscription.Url)
+
+	if err != nil {
+		return subscription, err
+	}
+
+	if !url_policy.SchemeAllowed(feed_url.Scheme) {
+		return subscription, &PolicyError{ERROR_FORBIDDEN_SCHEME, feed_url.Scheme}
+	}
+
+	if (subscription.Cron == "") == (subscription.Interval == 0) {
+		return subscription, fmt.Errorf("%s", ERROR_SUBSCRIPTION_SCHEDULE)
+	}
+
+	if subscription.Cron != "" {
+		_, err = cron.ParseStandard(subscription.Cron)
+
+		if err != nil {
+			return subscription, fmt.Errorf("%s: %v", ERROR_SUBSCRIPTION_CRON, err)
+		}
+	} else if time.Duration(subscription.Interval)*time.Second < min_interval {
+		return subscription, fmt.Errorf("%s: %ds < %v", ERROR_SUBSCRIPTION_INTERVAL, subscription.Interval, min_interval)
+	}
+
+	return subscription, nil
+}
+
+func SubscriptionToApi(subscription Subscription) *api.Subscription {
+	return &api.Subscription{
+		Id:         subscription.Id.Hex(),
+		Url:        subscription.Url,
+		Cron:       subscription.Cron,
+		Interval:   subscription.Interval,
+		Credential: subscription.Credential,
+		Force:      subscription.Force,
+		NextRun:    UnixToTimestamp(subscription.NextRun),
+		LastRun:    UnixToTimestamp(subscription.LastRun),
+		LastCount:  subscription.LastCount,
+		LastError:  subscription.LastError,
+	}
+}
+
+// UnixToTimestamp leaves the timestamp unset for 0, a run that has not
+// happened yet
+func UnixToTimestamp(unix int64) *timestamppb.Timestamp {
+	if unix == 0 {
+		return nil
+	}
+
+	return timestamppb.New(time.Unix(unix, 0))
+}
+
+// NextRun returns the unix time of the first run strictly after from
+func NextRun(subscription Subscription, from time.Time) int64 {
+	if subscription.Cron != "" {
+		schedule, err := cron.ParseStandard(subscription.Cron)
+
+		if err != nil {
+			return 0
+		}
+
+		return schedule.Next(from).Unix()
+	}
+
+	return from.Add(time.Duration(subscription.Interval) * time.Second).Unix()
+}
+
+// RunScheduler imports due subscriptions of all tenants every interval. All
+// instances behind HAProxy run it, ClaimSubscription makes sure each run
+// happens only once.
+func RunScheduler(ctx context.Context, s *server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			RunDueSubscriptions(s, time.Now())
+		}
+	}
+}
+
+func RunDueSubscriptions(s *server, now time.Time) {
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := ConnectMongo(mng_context)
+
+	if err != nil {
+		slog.Error("Cannot look for due subscriptions", "error", err)
+		return
+	}
+
+	defer client.Disconnect(mng_context)
+
+	tenants, err := Tenants(client, mng_context)
+
+	if err != nil {
+		slog.Error("Cannot list tenants", "error", err)
+		return
+	}
+
+	for _, tenant := range tenants {
+		RunDueTenantSubscriptions(s, SubscriptionsCollection(client, tenant), mng_context, tenant, now)
+	}
+}
+
+func RunDueTenantSubscriptions(s *server, collection mongo.Collection, mng_context context.Context, tenant string, now time.Time) {
+	cursor, err := collection.Find(mng_context, bson.M{"nextrun": bson.M{"$lte": now.Unix()}})
+
+	if err != nil {
+		slog.Error("Cannot load subscriptions", "tenant", tenant, "error", err)
+		return
+	}
+
+	var due []Subscription
+
+	err = cursor.All(mng_context, &due)
+
+	if err != nil {
+		slog.Error("Cannot load subscriptions", "tenant", tenant, "error", err)
+		return
+	}
+
+	for _, subscription := range due {
+		subscription.Tenant = tenant
+
+		// registered before the claim, so a draining instance leaves the run
+		// to the others and shutdown waits for the runs it owns
+		ctx, done, err := running_imports.Start(context.Background())
+
+		if err != nil {
+			return
+		}
+
+		claimed, err := ClaimSubscription(collection, mng_context, subscription, now)
+
+		if err != nil {
+			slog.Error("Cannot claim subscription", "subscription", subscription.Id.Hex(), "error", err)
+		}
+
+		if !claimed {
+			done()
+			continue
+		}
+
+		go func(subscription Subscription) {
+			defer done()
+
+			RunSubscription(ctx, s, subscription)
+		}(subscription)
+	}
+}
+
+// ClaimSubscription moves NextRun forward only if no other instance did it
+// first, the instance whose update matched owns this run.
+func ClaimSubscription(collection mongo.Collection, mng_context context.Context, subscription Subscription, now time.Time) (bool, error) {
+	filter := bson.M{"_id": subscription.Id, "nextrun": subscription.NextRun}
+	update := bson.M{"$set": bson.M{"nextrun": NextRun(subscription, now)}}
+
+	result, err := collection.UpdateOne(mng_context, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// RunSubscription imports the feed of subscription under ctx and records
+// the outcome on it
+func RunSubscription(ctx context.Context, s *server, subscription Subscription) {
+	ctx = WithRpcRequestId(WithTenant(ctx, subscription.Tenant), NewRpcRequestId())
+	ctx = WithSubscription(ctx, subscription.Id.Hex())
+
+	slog.InfoContext(ctx, "Running subscription", "subscription", subscription.Id.Hex(), "url", subscription.Url, "tenant", subscription.Tenant)
+
+	// scheduled runs skip the interceptors, fetch_timeout is applied here
+	if fetch_timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, fetch_timeout)
+
+		defer cancel()
+	}
+
+	response, err := s.Fetch(ctx, &api.FetchRequest{
+		Url:        subscription.Url,
+		Credential: subscription.Credential,
+		Force:      subscription.Force,
+	})
+
+	result := bson.M{"lastrun": time.Now().Unix(), "lasterror": ""}
+
+	if err != nil {
+		slog.WarnContext(ctx, "Subscription failed", "subscription", subscription.Id.Hex(), "error", err)
+
+		result["lasterror"] = err.Error()
+	} else {
+		result["lastcount"] = response.GetCount()
+	}
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := ConnectMongo(mng_context)
+
+	if err == nil {
+		defer client.Disconnect(mng_context)
+
+		collection := SubscriptionsCollection(client, subscription.Tenant)
+
+		_, err = collection.UpdateOne(mng_context, bson.M{"_id": subscription.Id}, bson.M{"$set": result})
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Cannot record subscription result", "subscription", subscription.Id.Hex(), "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionValidation(t *testing.T) {
+	valid := []*api.Subscription{
+		{Url: "https://example.com/products.csv", Cron: "*/15 * * * *"},
+		{Url: "https://example.com/products.csv", Cron: "@hourly"},
+		{Url: "https://example.com/products.csv", Interval: 3600},
+	}
+
+	for _, in := range valid {
+		_, err := SubscriptionFromApi(in)
+
+		require.NoError(t, err, "%v", in)
+	}
+
+	invalid := []*api.Subscription{
+		{Cron: "@hourly"},
+		{Url: "gopher://example.com/products.csv", Cron: "@hourly"},
+		{Url: "https://example.com/products.csv"},
+		{Url: "https://example.com/products.csv", Cron: "@hourly", Interval: 3600},
+		{Url: "https://example.com/products.csv", Cron: "61 * * * *"},
+		{Url: "https://example.com/products.csv", Interval: 1},
+	}
+
+	for _, in := range invalid {
+		_, err := SubscriptionFromApi(in)
+
+		require.Error(t, err, "%v", in)
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	from := time.Date(2021, 5, 1, 10, 7, 30, 0, time.Local)
+
+	next := NextRun(Subscription{Cron: "*/15 * * * *"}, from)
+
+	require.Equal(t, time.Date(2021, 5, 1, 10, 15, 0, 0, time.Local).Unix(), next)
+
+	next = NextRun(Subscription{Interval: 600}, from)
+
+	require.Equal(t, from.Add(10*time.Minute).Unix(), next)
+}
+
+func TestClaimSubscriptionOnlyOnce(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	collection := SubscriptionsCollection(client, DEFAULT_TENANT)
+
+	now := time.Now()
+
+	subscription := Subscription{
+		Id:       primitive.NewObjectID(),
+		Url:      "https://example.com/test_subscription.csv",
+		Interval: 600,
+		NextRun:  now.Add(-time.Minute).Unix(),
+	}
+
+	_, err := collection.InsertOne(mng_context, subscription)
+
+	require.NoError(t, err)
+
+	defer collection.DeleteOne(mng_context, bson.M{"_id": subscription.Id})
+
+	// two instances saw the same due subscription
+	first, err := ClaimSubscription(collection, mng_context, subscription, now)
+
+	require.NoError(t, err)
+
+	second, err := ClaimSubscription(collection, mng_context, subscription, now)
+
+	require.NoError(t, err)
+
+	require.True(t, first)
+	require.False(t, second)
+
+	var stored Subscription
+
+	require.NoError(t, collection.FindOne(mng_context, bson.M{"_id": subscription.Id}).Decode(&stored))
+	require.Equal(t, NextRun(subscription, now), stored.NextRun)
+}
+
+func TestDrainingInstanceLeavesSubscriptions(t *testing.T) {
+	defer func(previous *Imports) { running_imports = previous }(running_imports)
+
+	running_imports = NewImports()
+
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	collection := SubscriptionsCollection(client, DEFAULT_TENANT)
+
+	now := time.Now()
+
+	subscription := Subscription{
+		Id:       primitive.NewObjectID(),
+		Url:      "https://example.com/test_subscription_drain.csv",
+		Interval: 600,
+		NextRun:  now.Add(-time.Minute).Unix(),
+	}
+
+	_, err := collection.InsertOne(mng_context, subscription)
+
+	require.NoError(t, err)
+
+	defer collection.DeleteOne(mng_context, bson.M{"_id": subscription.Id})
+
+	running_imports.Cancel()
+
+	RunDueTenantSubscriptions(&server{}, collection, mng_context, DEFAULT_TENANT, now)
+
+	var stored Subscription
+
+	require.NoError(t, collection.FindOne(mng_context, bson.M{"_id": subscription.Id}).Decode(&stored))
+	require.Equal(t, subscription.NextRun, stored.NextRun)
+}
@@ -119,26 +119,26 @@ func TestDownloadFile(t *testing.T) {
 	url := "https://raw.githubusercontent.com/ksukhorukov/Atlant/master/samples/sample.csv"
 	tmp_file_path := RandomFile("../tmp", 64)
 
-	err := DownloadFile(url, tmp_file_path)
+	file_paths, err := DownloadFile(context.Background(), url, "", tmp_file_path, nil)
 
 	if err != nil {
 		t.Errorf("Cannot download sample file: %v\n", err)
 	}
 
-	DeleteFile(tmp_file_path)
+	DeleteFiles(file_paths)
 }
 
 func TestDownloadFileWithWrongMimeType(t *testing.T) {
 	url := "https://github.com/ksukhorukov/Atlant/raw/master/samples/golang.png"
 	tmp_file_path := RandomFile("../tmp", 64)
 
-	err := DownloadFile(url, tmp_file_path)
+	file_paths, err := DownloadFile(context.Background(), url, "", tmp_file_path, nil)
 
 	if err == nil {
 		t.Errorf("Function allows to download files with incorrect mime types\n")
 	}
 
-	DeleteFile(tmp_file_path)
+	DeleteFiles(file_paths)
 }
 
 func TestSuccessfullySaveResults(t *testing.T) {
@@ -155,7 +155,7 @@ func TestSuccessfullySaveResults(t *testing.T) {
 	product := "test_product_1111111111"
 	price := 99.9
 
-	result := SaveResults(collection, mng_context, product, price, time.Now().Unix())
+	result, _ := SaveResults(collection, mng_context, product, price, ImportJob{Time: time.Now().Unix()})
 
 	if result == false {
 		t.Errorf("Cannot save results to MongoDB\n")
@@ -182,13 +182,13 @@ func TestDontSaveProductsWithTheSamePrice(t *testing.T) {
 	product := "test_product_1111111111"
 	price := 99.9
 
-	result := SaveResults(collection, mng_context, product, price, time.Now().Unix())
+	result, _ := SaveResults(collection, mng_context, product, price, ImportJob{Time: time.Now().Unix()})
 
 	if result == false {
 		t.Errorf("Cannot save results to MongoDB\n")
 	}
 
-	result = SaveResults(collection, mng_context, product, price, time.Now().Unix())
+	result, _ = SaveResults(collection, mng_context, product, price, ImportJob{Time: time.Now().Unix()})
 
 	if result == true {
 		t.Errorf("Can save record with equal prices")
@@ -201,8 +201,8 @@ func TestDontSaveProductsWithTheSamePrice(t *testing.T) {
 	}
 }
 
-func SaveResultsStub(collection mongo.Collection, mng_context context.Context, product string, price float64, timestamp int64) bool {
-	return true
+func SaveResultsStub(collection mongo.Collection, mng_context context.Context, product string, price float64, job ImportJob) (bool, error) {
+	return true, nil
 }
 
 func TestParseCSV(t *testing.T) {
@@ -220,7 +220,7 @@ func TestParseCSV(t *testing.T) {
 
 	file_path := "../samples/sample.csv"
 
-	count, err := ParseCSV(file_path, saver, collection, mng_context, time.Now().Unix())
+	count, err := ParseCSV(file_path, saver, collection, mng_context, ImportJob{Time: time.Now().Unix()})
 
 	if err != nil {
 		t.Errorf("Parses returned error: %v", err)
@@ -246,7 +246,7 @@ func TestParseCSVProduceErrorWhenCannotOpenCSVFile(t *testing.T) {
 
 	file_path := "../samples/sample_abrakadabra.csv"
 
-	_, err := ParseCSV(file_path, saver, collection, mng_context, time.Now().Unix())
+	_, err := ParseCSV(file_path, saver, collection, mng_context, ImportJob{Time: time.Now().Unix()})
 
 	if err == nil {
 		t.Errorf("Parser allows to open non-existing files")
@@ -268,7 +268,7 @@ func TestParseCSVProduceErrorWhenCSVFilesHasIncorrectHeaders(t *testing.T) {
 
 	file_path := "../samples/invalid_headers.csv"
 
-	_, err := ParseCSV(file_path, saver, collection, mng_context, time.Now().Unix())
+	_, err := ParseCSV(file_path, saver, collection, mng_context, ImportJob{Time: time.Now().Unix()})
 
 	if err == nil {
 		t.Errorf("Parser successfully parsed CSV with invalid headers: %s\n", file_path)
@@ -290,7 +290,7 @@ func TestParseCSVProduceErrorWhenCSVFilesHasIncorrectStructure(t *testing.T) {
 
 	file_path := "../samples/invalid_structure.csv"
 
-	_, err := ParseCSV(file_path, saver, collection, mng_context, time.Now().Unix())
+	_, err := ParseCSV(file_path, saver, collection, mng_context, ImportJob{Time: time.Now().Unix()})
 
 	if err == nil {
 		t.Errorf("Parser successfully parsed CSV with invalid structure: %s\n", file_path)
@@ -312,7 +312,7 @@ func TestParseCSVProduceErrorWhenCSVFilesHasIncorrectValues(t *testing.T) {
 
 	file_path := "../samples/invalid_structure.csv"
 
-	_, err := ParseCSV(file_path, saver, collection, mng_context, time.Now().Unix())
+	_, err := ParseCSV(file_path, saver, collection, mng_context, ImportJob{Time: time.Now().Unix()})
 
 	if err == nil {
 		t.Errorf("Parser successfully parsed CSV with invalid values: %s\n", file_path)
@@ -410,16 +410,16 @@ func TestSearch(t *testing.T) {
 
 	file_path := "../samples/small_csv_sample.csv"
 
-	_, err := ParseCSV(file_path, saver, collection, mng_context, time.Now().Unix())
+	_, err := ParseCSV(file_path, saver, collection, mng_context, ImportJob{Time: time.Now().Unix()})
 
 	if err != nil {
 		t.Errorf("Cannot parse sample CSV file: %v\n", err)
 	}
 
-	var results []api.Result
+	var results []*api.Result
 
 	//sort by price in ascending order
-	results = Search(int64(1), int64(10), "price", int32(1), collection, mng_context)
+	results, _ = Search(int64(1), int64(10), "price", int32(1), "", collection, mng_context)
 
 	products_sorted_by_price := [5]string{"test_product_410073300",
 		"test_product_434077606",
@@ -435,7 +435,7 @@ func TestSearch(t *testing.T) {
 	}
 
 	//sort by product name in descending order
-	results = Search(int64(1), int64(10), "product", int32(-1), collection, mng_context)
+	results, _ = Search(int64(1), int64(10), "product", int32(-1), "", collection, mng_context)
 
 	products_sorted_by_name := [5]string{"test_product_634954705",
 		"test_product_615830659",
@@ -471,6 +471,15 @@ func deleteTmpData() {
 			fmt.Printf("Cannot delete product %s from MongoDB\n", product)
 		}
 	}
+
+	sources := SourcesCollection(client, DEFAULT_TENANT)
+
+	// forget validators too, otherwise the next fetch is "not modified"
+	_, err := sources.DeleteOne(mng_context, bson.M{"url": "https://raw.githubusercontent.com/ksukhorukov/Atlant/master/samples/small_csv_sample.csv"})
+
+	if err != nil {
+		fmt.Printf("Cannot delete source state from MongoDB\n")
+	}
 }
 
 func TestFetchRequestResponse(t *testing.T) {
@@ -540,3 +549,47 @@ func TestListRequestResponse(t *testing.T) {
 		require.Equal(t, results[i].GetProduct(), products_sorted_by_name[i])
 	}
 }
+
+func TestSaveResultsRecordsProvenance(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, collection := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	product := "test_product_provenance"
+
+	defer collection.DeleteOne(mng_context, bson.M{"product": product})
+
+	first := ImportJob{Id: "first", Source: "https://supplier-a.com/products.csv", Time: time.Now().Unix()}
+	second := ImportJob{Id: "second", Source: "https://supplier-b.com/products.csv", Time: time.Now().Unix()}
+
+	SaveResults(collection, mng_context, product, 10.5, first)
+
+	// same price, the first supplier still owns it
+	SaveResults(collection, mng_context, product, 10.5, second)
+
+	results, _ := Search(int64(1), int64(10), "product", int32(1), first.Source, collection, mng_context)
+
+	if len(results) != 1 || results[0].GetImportId() != first.Id {
+		t.Errorf("Expecting the product from %s, got %v\n", first.Source, results)
+	}
+
+	SaveResults(collection, mng_context, product, 11.5, second)
+
+	results, _ = Search(int64(1), int64(10), "product", int32(1), first.Source, collection, mng_context)
+
+	if len(results) != 0 {
+		t.Errorf("Expecting no products from %s, got %v\n", first.Source, results)
+	}
+
+	results, _ = Search(int64(1), int64(10), "product", int32(1), second.Source, collection, mng_context)
+
+	if len(results) != 1 || results[0].GetSource() != second.Source || results[0].GetImportId() != second.Id {
+		t.Errorf("Expecting the product from %s, got %v\n", second.Source, results)
+	}
+}
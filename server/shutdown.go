@@ -0,0 +1,257 @@
+package main
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DEFAULT_DRAIN_DELAY gives HAProxy time to see the failing health check
+	// before we stop accepting calls, see config/haproxy.cfg
+	DEFAULT_DRAIN_DELAY   = 5 * time.Second
+	DEFAULT_DRAIN_TIMEOUT = 30 * time.Second
+
+	// CANCEL_TIMEOUT is how long cancelled imports get to unwind
+	CANCEL_TIMEOUT = 5 * time.Second
+
+	ERROR_SHUTTING_DOWN = "Server is shutting down"
+)
+
+var drain_delay = DEFAULT_DRAIN_DELAY
+var drain_timeout = DEFAULT_DRAIN_TIMEOUT
+
+var running_imports = NewImports()
+
+// ErrStore marks an import that failed writing to MongoDB rather than on
+// the feed itself
+var ErrStore = errors.New("Cannot save product")
+
+// Imports tracks the imports running on this instance, RPCs and scheduled
+// ones alike, so shutdown can wait for them or cancel them.
+type Imports struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  sync.WaitGroup
+	mutex  sync.Mutex
+}
+
+func NewImports() *Imports {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Imports{ctx: ctx, cancel: cancel}
+}
+
+// Start registers an import running under parent. The context returned is
+// also cancelled by Cancel, call done when the import returns.
+func (i *Imports) Start(parent context.Context) (context.Context, func(), error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.Cancelled() {
+		return nil, nil, status.Error(codes.Unavailable, ERROR_SHUTTING_DOWN)
+	}
+
+	i.group.Add(1)
+
+	ctx, cancel := context.WithCancel(parent)
+	finished := make(chan struct{})
+
+	go func() {
+		select {
+		case <-i.ctx.Done():
+			cancel()
+		case <-finished:
+		}
+	}()
+
+	done := func() {
+		close(finished)
+		cancel()
+
+		i.group.Done()
+	}
+
+	return ctx, done, nil
+}
+
+func (i *Imports) Cancel() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.cancel()
+}
+
+func (i *Imports) Cancelled() bool {
+	return i.ctx.Err() != nil
+}
+
+func (i *Imports) Wait() {
+	i.group.Wait()
+}
+
+// ImportError is the status of an import that stopped on err after saving
+// count products. What is saved stays, the source state is not advanced so
+// the next fetch of the feed downloads it again and skips unchanged rows.
+func ImportError(ctx context.Context, url string, count int64, code codes.Code, err error) error {
+	switch {
+	case running_imports.Cancelled():
+		slog.WarnContext(ctx, "Import interrupted by shutdown", "url", url, "count", count)
+
+		return status.Errorf(codes.Unavailable, "%s, import interrupted after %d products", ERROR_SHUTTING_DOWN, count)
+	case ctx.Err() == context.DeadlineExceeded:
+		code = codes.DeadlineExceeded
+	case ctx.Err() == context.Canceled:
+		code = codes.Canceled
+	case errors.Is(err, ErrStore):
+		code = codes.Unavailable
+	}
+
+	slog.WarnContext(ctx, "Import failed", "url", url, "count", count, "error", err)
+
+	return status.Errorf(code, "%v", err)
+}
+
+// stopper is the part of grpc.Server shutdown needs
+type stopper interface {
+	GracefulStop()
+	Stop()
+}
+
+// Shutdown drains the instance: the health check fails so HAProxy moves
+// new calls elsewhere, the scheduler, webhooks and watch streams stop,
+// running calls and imports get DrainTimeout to finish and are cancelled
+// after it. Gateway calls drain the same way, through the Backend they are
+// made to.
+type Shutdown struct {
+	Server        stopper
+	Gateway       *http.Server
+	Backend       stopper
+	Health        *HealthChecker
+	HTTP          *http.Server
+	Admin         *http.Server
+	StopScheduler context.CancelFunc
+	StopWatchers  context.CancelFunc
+	StopWebhooks  context.CancelFunc
+	Imports       *Imports
+
+	DrainDelay   time.Duration
+	DrainTimeout time.Duration
+}
+
+func (sd *Shutdown) stopGateway() {
+	if sd.Gateway != nil {
+		sd.Gateway.Shutdown(context.Background())
+	}
+
+	if sd.Backend != nil {
+		sd.Backend.GracefulStop()
+	}
+}
+
+func (sd *Shutdown) Run() {
+	if sd.Health != nil {
+		sd.Health.Drain()
+	}
+
+	if sd.StopScheduler != nil {
+		sd.StopScheduler()
+	}
+
+	if sd.StopWatchers != nil {
+		sd.StopWatchers()
+	}
+
+	if sd.StopWebhooks != nil {
+		sd.StopWebhooks()
+	}
+
+	time.Sleep(sd.DrainDelay)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		gateway_stopped := make(chan struct{})
+
+		go func() {
+			sd.stopGateway()
+
+			close(gateway_stopped)
+		}()
+
+		sd.Server.GracefulStop()
+
+		<-gateway_stopped
+
+		sd.Imports.Wait()
+
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(sd.DrainTimeout):
+		slog.Warn("Drain timeout reached, cancelling running imports", "timeout", sd.DrainTimeout.String())
+
+		sd.Imports.Cancel()
+		sd.Server.Stop()
+
+		if sd.Gateway != nil {
+			sd.Gateway.Close()
+		}
+
+		if sd.Backend != nil {
+			sd.Backend.Stop()
+		}
+
+		select {
+		case <-stopped:
+		case <-time.After(CANCEL_TIMEOUT):
+			slog.Error("Imports did not stop in time", "timeout", CANCEL_TIMEOUT.String())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+
+	defer cancel()
+
+	for _, endpoint := range []*http.Server{sd.HTTP, sd.Admin} {
+		if endpoint != nil {
+			endpoint.Shutdown(ctx)
+		}
+	}
+}
+
+// ShutdownOnSignal runs shutdown on the first SIGTERM or SIGINT and closes
+// the returned channel once it is done
+func ShutdownOnSignal(sd *Shutdown) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		received := <-signals
+
+		signal.Stop(signals)
+
+		slog.Info("Draining", "signal", received.String())
+
+		sd.Run()
+
+		slog.Info("Stopped")
+
+		close(done)
+	}()
+
+	return done
+}
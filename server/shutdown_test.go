@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stubServer finishes its graceful stop once released or stopped
+type stubServer struct {
+	release chan struct{}
+	stopped bool
+}
+
+func (s *stubServer) GracefulStop() {
+	<-s.release
+}
+
+func (s *stubServer) Stop() {
+	s.stopped = true
+
+	close(s.release)
+}
+
+func TestShutdownWaitsForImports(t *testing.T) {
+	imports := NewImports()
+
+	_, done, err := imports.Start(context.Background())
+
+	require.NoError(t, err)
+
+	checker := NewHealthChecker(func(context.Context) error { return nil })
+	server := &stubServer{release: make(chan struct{})}
+
+	close(server.release)
+
+	scheduler_stopped := false
+	watchers_stopped := false
+
+	shutdown := &Shutdown{
+		Server:        server,
+		Health:        checker,
+		Imports:       imports,
+		StopScheduler: func() { scheduler_stopped = true },
+		StopWatchers:  func() { watchers_stopped = true },
+		DrainTimeout:  time.Minute,
+	}
+
+	finished := make(chan struct{})
+
+	go func() {
+		shutdown.Run()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		t.Fatal("Shutdown did not wait for the running import")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checker.Status())
+
+	done()
+
+	<-finished
+
+	require.True(t, scheduler_stopped)
+	require.True(t, watchers_stopped)
+	require.False(t, server.stopped)
+	require.False(t, imports.Cancelled())
+}
+
+func TestShutdownCancelsImportsAfterDrainTimeout(t *testing.T) {
+	imports := NewImports()
+
+	ctx, done, err := imports.Start(context.Background())
+
+	require.NoError(t, err)
+
+	// an import stops once its context is cancelled
+	go func() {
+		<-ctx.Done()
+		done()
+	}()
+
+	server := &stubServer{release: make(chan struct{})}
+
+	shutdown := &Shutdown{Server: server, Imports: imports, DrainTimeout: 50 * time.Millisecond}
+
+	shutdown.Run()
+
+	require.True(t, server.stopped)
+	require.True(t, imports.Cancelled())
+
+	_, _, err = imports.Start(context.Background())
+
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestParseCSVStopsWhenCancelled(t *testing.T) {
+	file_path := filepath.Join(t.TempDir(), "feed.csv")
+
+	require.NoError(t, ioutil.WriteFile(file_path, []byte("PRODUCT NAME;PRICE\na;1\nb;2\nc;3\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	saved := 0
+
+	saver := func(collection mongo.Collection, mng_context context.Context, product string, price float64, job ImportJob) (bool, error) {
+		saved += 1
+
+		if saved == 2 {
+			cancel()
+		}
+
+		return true, nil
+	}
+
+	count, err := ParseCSV(file_path, saver, mongo.Collection{}, ctx, ImportJob{})
+
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, int64(2), count)
+
+	failing := func(collection mongo.Collection, mng_context context.Context, product string, price float64, job ImportJob) (bool, error) {
+		return false, errors.New("connection reset")
+	}
+
+	_, err = ParseCSV(file_path, failing, mongo.Collection{}, context.Background(), ImportJob{})
+
+	require.True(t, errors.Is(err, ErrStore))
+}
+
+func TestImportErrorCodes(t *testing.T) {
+	defer func(previous *Imports) { running_imports = previous }(running_imports)
+
+	running_imports = NewImports()
+
+	ctx := context.Background()
+
+	err := ImportError(ctx, "http://feeds/a.csv", 0, codes.InvalidArgument, fmt.Errorf("%s", ERROR_INCORRECT_HEADERS))
+
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	err = ImportError(ctx, "http://feeds/a.csv", 3, codes.InvalidArgument, fmt.Errorf("%w: %v", ErrStore, "connection reset"))
+
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+
+	defer cancel()
+
+	err = ImportError(expired, "http://feeds/a.csv", 3, codes.InvalidArgument, expired.Err())
+
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	running_imports.Cancel()
+
+	err = ImportError(ctx, "http://feeds/a.csv", 3, codes.InvalidArgument, context.Canceled)
+
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), ERROR_SHUTTING_DOWN)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+const (
+	DEFAULT_DB_SOURCES_COLLECTION_NAME = "sources"
+)
+
+// ErrNotModified is returned by DownloadFile when the feed is unchanged
+// since the previous successful import.
+var ErrNotModified = errors.New("Feed has not been modified")
+
+var db_sources_collection_name = DEFAULT_DB_SOURCES_COLLECTION_NAME
+
+// SourceState is what we remember about a feed URL between imports
+type SourceState struct {
+	Url          string
+	ETag         string
+	LastModified string
+	ContentHash  string
+	FetchTime    int64
+}
+
+func SourcesCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_sources_collection_name)
+}
+
+// LoadSourceState returns the stored state for url, or an empty state if
+// the feed has never been imported.
+func LoadSourceState(collection mongo.Collection, mng_context context.Context, url string) (SourceState, error) {
+	state := SourceState{Url: url}
+
+	err := collection.FindOne(mng_context, bson.M{"url": url}).Decode(&state)
+
+	if err == mongo.ErrNoDocuments {
+		return SourceState{Url: url}, nil
+	}
+
+	return state, err
+}
+
+func SaveSourceState(collection mongo.Collection, mng_context context.Context, state SourceState) error {
+	opts := options.Replace().SetUpsert(true)
+
+	_, err := collection.ReplaceOne(mng_context, bson.M{"url": state.Url}, state, opts)
+
+	return err
+}
+
+// SetConditionalHeaders turns the remembered validators into
+// If-None-Match / If-Modified-Since headers.
+func SetConditionalHeaders(request *http.Request, state *SourceState) {
+	if state.ETag != "" {
+		request.Header.Set("If-None-Match", state.ETag)
+	}
+
+	if state.LastModified != "" {
+		request.Header.Set("If-Modified-Since", state.LastModified)
+	}
+}
+
+// UpdateSourceState records validators and content hash of a fresh download.
+// It reports false when the body is identical to the one imported last time.
+func UpdateSourceState(state *SourceState, download *Download) bool {
+	hash := ContentHash(download.Body)
+	changed := hash != state.ContentHash
+
+	state.ETag = download.ETag
+	state.LastModified = download.LastModified
+	state.ContentHash = hash
+
+	return changed
+}
+
+func ContentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
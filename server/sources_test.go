@@ -0,0 +1,181 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConditionalDownload(t *testing.T) {
+	sample := readSample(t)
+
+	etag := `"v1"`
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write(sample)
+	}))
+
+	defer ts.Close()
+
+	state := SourceState{Url: ts.URL}
+
+	file_paths, err := DownloadFile(context.Background(), ts.URL, "", RandomFile("../tmp", 64), &state)
+
+	DeleteFiles(file_paths)
+
+	require.NoError(t, err)
+	require.Len(t, file_paths, 1)
+	require.Equal(t, etag, state.ETag)
+	require.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", state.LastModified)
+	require.Equal(t, ContentHash(sample), state.ContentHash)
+
+	_, err = DownloadFile(context.Background(), ts.URL, "", RandomFile("../tmp", 64), &state)
+
+	require.Equal(t, ErrNotModified, err)
+	require.Equal(t, 2, requests)
+}
+
+func TestDownloadSkipsUnchangedContent(t *testing.T) {
+	sample := readSample(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sample)
+	}))
+
+	defer ts.Close()
+
+	state := SourceState{Url: ts.URL, ContentHash: ContentHash(sample)}
+
+	_, err := DownloadFile(context.Background(), ts.URL, "", RandomFile("../tmp", 64), &state)
+
+	require.Equal(t, ErrNotModified, err)
+
+	state.ContentHash = ContentHash([]byte("previous content"))
+
+	file_paths, err := DownloadFile(context.Background(), ts.URL, "", RandomFile("../tmp", 64), &state)
+
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(file_paths[0])
+
+	DeleteFiles(file_paths)
+
+	require.NoError(t, err)
+	require.Equal(t, sample, data)
+}
+
+func TestSaveAndLoadSourceState(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	sources := SourcesCollection(client, DEFAULT_TENANT)
+
+	url := "http://localhost/test_source_state.csv"
+
+	state, err := LoadSourceState(sources, mng_context, url)
+
+	require.NoError(t, err)
+	require.Equal(t, SourceState{Url: url}, state)
+
+	state.ETag = `"abc"`
+	state.ContentHash = ContentHash([]byte("data"))
+
+	require.NoError(t, SaveSourceState(sources, mng_context, state))
+
+	defer sources.DeleteOne(mng_context, bson.M{"url": url})
+
+	loaded, err := LoadSourceState(sources, mng_context, url)
+
+	require.NoError(t, err)
+	require.Equal(t, state, loaded)
+}
+
+func TestImportFeedKeepsNewValidators(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, collection := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	sources := SourcesCollection(client, DEFAULT_TENANT)
+
+	body := []byte("PRODUCT NAME;PRICE\ntest_product_new_validators;1.5\n")
+
+	var conditions []string
+
+	// the ETag changes once while the body stays the same
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		condition := r.Header.Get("If-None-Match")
+
+		conditions = append(conditions, condition)
+
+		if condition == `"v2"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if condition == `"v1"` {
+			w.Header().Set("ETag", `"v2"`)
+		} else {
+			w.Header().Set("ETag", `"v1"`)
+		}
+
+		w.Write(body)
+	}))
+
+	defer ts.Close()
+
+	defer sources.DeleteOne(mng_context, bson.M{"url": ts.URL})
+	defer collection.DeleteOne(mng_context, bson.M{"product": "test_product_new_validators"})
+
+	in := &api.FetchRequest{Url: ts.URL}
+
+	response, err := ImportFeed(sources, collection, mng_context, in)
+
+	require.NoError(t, err)
+	require.Equal(t, int64(1), response.GetCount())
+
+	for i := 0; i < 2; i++ {
+		response, err = ImportFeed(sources, collection, mng_context, in)
+
+		require.NoError(t, err)
+		require.True(t, response.GetNotModified())
+	}
+
+	require.Equal(t, []string{"", `"v1"`, `"v2"`}, conditions)
+
+	state, err := LoadSourceState(sources, mng_context, ts.URL)
+
+	require.NoError(t, err)
+	require.Equal(t, `"v2"`, state.ETag)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// TENANT_METADATA_KEY is the gRPC metadata entry naming the catalogue
+	// a call works with
+	TENANT_METADATA_KEY = "atlant-tenant"
+
+	// DEFAULT_TENANT is the catalogue of calls without a tenant, it lives
+	// in the --mongo_database database as before tenants were introduced
+	DEFAULT_TENANT = ""
+
+	ERROR_TENANT_NAME     = "Incorrect tenant name"
+	ERROR_TENANT_REQUIRED = "Tenant is required"
+)
+
+var require_tenant = false
+
+var tenant_name = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type tenantKey struct{}
+
+// Every tenant has a database of its own: products, sources, locks,
+// requests and subscriptions never mix between catalogues.
+func TenantDatabase(client mongo.Client, tenant string) *mongo.Database {
+	return client.Database(TenantDatabaseName(tenant))
+}
+
+func TenantDatabaseName(tenant string) string {
+	if tenant == DEFAULT_TENANT {
+		return db_name
+	}
+
+	return db_name + "_" + tenant
+}
+
+// TenantFromDatabaseName reports which tenant a database belongs to
+func TenantFromDatabaseName(name string) (string, bool) {
+	if name == db_name {
+		return DEFAULT_TENANT, true
+	}
+
+	if strings.HasPrefix(name, db_name+"_") {
+		tenant := strings.TrimPrefix(name, db_name+"_")
+
+		return tenant, CheckTenant(tenant) == nil
+	}
+
+	return "", false
+}
+
+// Tenants lists the tenants that have a database
+func Tenants(client mongo.Client, mng_context context.Context) ([]string, error) {
+	filter := bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(db_name)}}
+
+	names, err := client.ListDatabaseNames(mng_context, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []string
+
+	for _, name := range names {
+		if tenant, ok := TenantFromDatabaseName(name); ok {
+			tenants = append(tenants, tenant)
+		}
+	}
+
+	return tenants, nil
+}
+
+func CheckTenant(tenant string) error {
+	if !tenant_name.MatchString(tenant) {
+		return fmt.Errorf("%s: %q", ERROR_TENANT_NAME, tenant)
+	}
+
+	return nil
+}
+
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+
+	return tenant
+}
+
+// IncomingTenant validates the tenant a client sent in metadata
+func IncomingTenant(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(TENANT_METADATA_KEY)
+
+	if len(values) == 0 || values[0] == "" {
+		if require_tenant {
+			return "", status.Errorf(codes.InvalidArgument, "%s", ERROR_TENANT_REQUIRED)
+		}
+
+		return DEFAULT_TENANT, nil
+	}
+
+	if len(values) > 1 {
+		return "", status.Errorf(codes.InvalidArgument, "%s: %v", ERROR_TENANT_NAME, values)
+	}
+
+	err := CheckTenant(values[0])
+
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return values[0], nil
+}
+
+// TenantUnaryInterceptor scopes every unary call to the tenant of its metadata
+func TenantUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	tenant, err := IncomingTenant(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(WithTenant(ctx, tenant), req)
+}
+
+// TenantStreamInterceptor does the same for streaming calls
+func TenantStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	tenant, err := IncomingTenant(ss.Context())
+
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &contextStream{ss, WithTenant(ss.Context(), tenant)})
+}
+
+// contextStream replaces the context of a server stream
+type contextStream struct {
+	grpc.ServerStream
+
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCheckTenant(t *testing.T) {
+	for _, tenant := range []string{"retail", "unit-b", "eu_west_2"} {
+		require.NoError(t, CheckTenant(tenant), tenant)
+	}
+
+	for _, tenant := range []string{"", "Retail", "-retail", "unit.b", "unit/b", "a$b", "abcdefghijklmnopqrstuvwxyz0123456"} {
+		require.Error(t, CheckTenant(tenant), tenant)
+	}
+}
+
+func TestTenantDatabaseName(t *testing.T) {
+	require.Equal(t, db_name, TenantDatabaseName(DEFAULT_TENANT))
+	require.Equal(t, db_name+"_retail", TenantDatabaseName("retail"))
+
+	for _, tenant := range []string{DEFAULT_TENANT, "retail"} {
+		found, ok := TenantFromDatabaseName(TenantDatabaseName(tenant))
+
+		require.True(t, ok)
+		require.Equal(t, tenant, found)
+	}
+
+	for _, name := range []string{"admin", "atlantis", db_name + "_"} {
+		_, ok := TenantFromDatabaseName(name)
+
+		require.False(t, ok, name)
+	}
+}
+
+func TestTenantUnaryInterceptor(t *testing.T) {
+	call := func(md metadata.MD) (string, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+
+		tenant, err := TenantUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return TenantFromContext(ctx), nil
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		return tenant.(string), nil
+	}
+
+	tenant, err := call(metadata.Pairs(TENANT_METADATA_KEY, "retail"))
+
+	require.NoError(t, err)
+	require.Equal(t, "retail", tenant)
+
+	tenant, err = call(metadata.MD{})
+
+	require.NoError(t, err)
+	require.Equal(t, DEFAULT_TENANT, tenant)
+
+	_, err = call(metadata.Pairs(TENANT_METADATA_KEY, "../admin"))
+
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = call(metadata.Pairs(TENANT_METADATA_KEY, "retail", TENANT_METADATA_KEY, "wholesale"))
+
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	require_tenant = true
+
+	defer func() { require_tenant = false }()
+
+	_, err = call(metadata.MD{})
+
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTenantsDoNotShareProducts(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, _ := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	retail := ProductsCollection(client, "test-retail")
+	wholesale := ProductsCollection(client, "test-wholesale")
+
+	defer TenantDatabase(client, "test-retail").Drop(mng_context)
+	defer TenantDatabase(client, "test-wholesale").Drop(mng_context)
+
+	SaveResults(retail, mng_context, "test_product_tenant", 10.5, ImportJob{Time: time.Now().Unix()})
+
+	results, _ := Search(int64(1), int64(10), "product", int32(1), "", retail, mng_context)
+
+	require.Len(t, results, 1)
+
+	results, _ = Search(int64(1), int64(10), "product", int32(1), "", wholesale, mng_context)
+
+	require.Empty(t, results)
+
+	tenants, err := Tenants(client, mng_context)
+
+	require.NoError(t, err)
+	require.Contains(t, tenants, "test-retail")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ERROR_TLS_KEY_PAIR  = "TLS requires both --tls_cert and --tls_key"
+	ERROR_TLS_CLIENT_CA = "Cannot parse client CA certificates"
+)
+
+var tls_cert = ""
+var tls_key = ""
+var client_ca = ""
+var require_client_cert = true
+
+// CertReloader serves the certificate, key and client CA from disk and
+// picks up new files on the next handshake after they change, so renewed
+// certificates don't need a restart.
+type CertReloader struct {
+	CertFile          string
+	KeyFile           string
+	CAFile            string
+	RequireClientCert bool
+
+	mutex    sync.Mutex
+	modified time.Time
+	config   *tls.Config
+}
+
+// NewCertReloader loads the files once and fails if they are unusable
+func NewCertReloader(cert_file string, key_file string, ca_file string, require bool) (*CertReloader, error) {
+	if cert_file == "" || key_file == "" {
+		return nil, fmt.Errorf("%s", ERROR_TLS_KEY_PAIR)
+	}
+
+	reloader := &CertReloader{
+		CertFile:          cert_file,
+		KeyFile:           key_file,
+		CAFile:            ca_file,
+		RequireClientCert: require,
+	}
+
+	_, err := reloader.Config()
+
+	return reloader, err
+}
+
+// TLSConfig is what the server starts with, every handshake asks the
+// reloader for the current configuration.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.Config()
+		},
+	}
+}
+
+// Config returns the configuration for the current files. A broken update
+// is logged and the previous configuration kept.
+func (r *CertReloader) Config() (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modified, err := r.LastModified()
+
+	if err == nil && r.config != nil && !modified.After(r.modified) {
+		return r.config, nil
+	}
+
+	if err == nil {
+		var config *tls.Config
+
+		config, err = r.load()
+
+		if err == nil {
+			if r.config != nil {
+				slog.Info("Reloaded TLS certificate", "file", r.CertFile)
+			}
+
+			r.config = config
+			r.modified = modified
+
+			return config, nil
+		}
+	}
+
+	if r.config == nil {
+		return nil, err
+	}
+
+	slog.Error("Cannot reload TLS certificate, keeping the previous one", "error", err)
+
+	r.modified = modified
+
+	return r.config, nil
+}
+
+// LastModified is the newest modification time of the files
+func (r *CertReloader) LastModified() (time.Time, error) {
+	var latest time.Time
+
+	for _, file_path := range []string{r.CertFile, r.KeyFile, r.CAFile} {
+		if file_path == "" {
+			continue
+		}
+
+		info, err := os.Stat(file_path)
+
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (r *CertReloader) load() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+
+	if r.CAFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(r.CAFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: %s", ERROR_TLS_CLIENT_CA, r.CAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	if r.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "atlant test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for name and its key, returns their paths
+func (ca *testCA) issue(t *testing.T, directory string, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	key_der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cert_path := filepath.Join(directory, name+".pem")
+	key_path := filepath.Join(directory, name+".key")
+
+	require.NoError(t, ioutil.WriteFile(cert_path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(key_path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600))
+
+	return cert_path, key_path
+}
+
+// handshake connects to a TLS listener and returns the server certificate
+func handshake(t *testing.T, address string, ca *testCA, client *tls.Certificate) (*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+
+	if client != nil {
+		config.Certificates = []tls.Certificate{*client}
+	}
+
+	conn, err := tls.Dial("tcp", address, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// client certificate errors show up on the first read with TLS 1.3
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = conn.Read(make([]byte, 1))
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = nil
+	}
+
+	return conn.ConnectionState().PeerCertificates[0], err
+}
+
+func serveTLS(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				conn.(*tls.Conn).Handshake()
+
+				time.Sleep(2 * time.Second)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestMutualTLS(t *testing.T) {
+	directory := t.TempDir()
+
+	ca := newTestCA(t)
+	ca_path := filepath.Join(directory, "ca.pem")
+
+	require.NoError(t, ioutil.WriteFile(ca_path, ca.pem, 0600))
+
+	cert_path, key_path := ca.issue(t, directory, "server", 2, x509.ExtKeyUsageServerAuth)
+	client_cert, client_key := ca.issue(t, directory, "importer", 3, x509.ExtKeyUsageClientAuth)
+
+	reloader, err := NewCertReloader(cert_path, key_path, ca_path, true)
+
+	require.NoError(t, err)
+
+	address := serveTLS(t, reloader.TLSConfig())
+
+	client, err := tls.LoadX509KeyPair(client_cert, client_key)
+	require.NoError(t, err)
+
+	_, err = handshake(t, address, ca, &client)
+
+	require.NoError(t, err)
+
+	_, err = handshake(t, address, ca, nil)
+
+	require.Error(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	directory := t.TempDir()
+
+	ca := newTestCA(t)
+
+	cert_path, key_path := ca.issue(t, directory, "server", 2, x509.ExtKeyUsageServerAuth)
+
+	reloader, err := NewCertReloader(cert_path, key_path, "", false)
+
+	require.NoError(t, err)
+
+	address := serveTLS(t, reloader.TLSConfig())
+
+	served, err := handshake(t, address, ca, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, int64(2), served.SerialNumber.Int64())
+
+	// renewed certificate
+	ca.issue(t, directory, "server", 4, x509.ExtKeyUsageServerAuth)
+
+	later := time.Now().Add(time.Second)
+
+	require.NoError(t, os.Chtimes(cert_path, later, later))
+	require.NoError(t, os.Chtimes(key_path, later, later))
+
+	served, err = handshake(t, address, ca, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, int64(4), served.SerialNumber.Int64())
+
+	// a broken update keeps the previous certificate
+	require.NoError(t, ioutil.WriteFile(key_path, []byte("garbage"), 0600))
+
+	later = later.Add(time.Second)
+
+	require.NoError(t, os.Chtimes(key_path, later, later))
+
+	served, err = handshake(t, address, ca, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, int64(4), served.SerialNumber.Int64())
+
+	_, err = NewCertReloader(cert_path, key_path, "", false)
+
+	require.Error(t, err)
+}
+
+func TestClientCertificateIdentity(t *testing.T) {
+	directory := t.TempDir()
+
+	ca := newTestCA(t)
+
+	cert_path, _ := ca.issue(t, directory, "importer", 3, x509.ExtKeyUsageClientAuth)
+
+	data, err := ioutil.ReadFile(cert_path)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(data)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	certs := writeJSON(t, map[string]*CertSubject{"importer": {Roles: []string{ROLE_WRITER}}})
+
+	auth, err := NewAuthenticator(AuthConfig{ClientCerts: certs})
+
+	require.NoError(t, err)
+
+	with_cert := func(cert *x509.Certificate) context.Context {
+		info := credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}}
+
+		return peer.NewContext(incoming(), &peer.Peer{AuthInfo: info})
+	}
+
+	ctx, err := auth.Check(with_cert(cert), MethodName("Fetch"))
+
+	require.NoError(t, err)
+	require.Equal(t, "importer", IdentityFromContext(ctx).Name)
+	require.Equal(t, "tls", IdentityFromContext(ctx).Method)
+
+	_, err = auth.Check(with_cert(ca.cert), MethodName("Fetch"))
+
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// presented but not verified
+	unverified := credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}
+
+	_, err = auth.Check(peer.NewContext(incoming(), &peer.Peer{AuthInfo: unverified}), MethodName("Fetch"))
+
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"google.golang.org/grpc"
+
+	"context"
+	"os"
+)
+
+const (
+	TRACER_NAME  = "github.com/ksukhorukov/atlant/server"
+	SERVICE_NAME = "atlant"
+
+	DEFAULT_TRACE_RATIO = 1.0
+)
+
+// otlp_endpoint is the host:port of an OTLP/gRPC collector, spans are not
+// exported when it is empty
+var otlp_endpoint string
+var otlp_insecure bool
+var trace_ratio = DEFAULT_TRACE_RATIO
+
+// Tracer is looked up on every use so that tests can swap the provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// SetupTracing installs the W3C trace context propagator and, when endpoint
+// is set, a provider batching spans to the collector. The returned function
+// flushes the spans still buffered.
+func SetupTracing(ctx context.Context, endpoint string, insecure bool, ratio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewTracerProvider(exporter, ratio)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// NewTracerProvider batches the sampled spans to exporter. Calls that come
+// with a sampled trace context are always traced, ratio applies to the rest.
+func NewTracerProvider(exporter sdktrace.SpanExporter, ratio float64) *sdktrace.TracerProvider {
+	hostname, _ := os.Hostname()
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", SERVICE_NAME),
+			attribute.String("service.instance.id", hostname),
+		)),
+	)
+}
+
+// TracingServerOption starts a span for every call, continuing the trace
+// of the client when it sent one
+func TracingServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler())
+}
+
+// EndSpan marks span failed when err is set and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// recordSpans sends the spans of the test to memory
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+
+	previous := otel.GetTracerProvider()
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previous)
+	})
+
+	return exporter
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	require.Failf(t, "span not found", "%s in %d spans", name, len(spans))
+
+	return tracetest.SpanStub{}
+}
+
+func TestParseCSVSpans(t *testing.T) {
+	exporter := recordSpans(t)
+
+	file_path := filepath.Join(t.TempDir(), "feed.csv")
+
+	require.NoError(t, ioutil.WriteFile(file_path, []byte("PRODUCT NAME;PRICE\na;1\nb;2\n"), 0600))
+
+	saver := func(collection mongo.Collection, mng_context context.Context, product string, price float64, job ImportJob) (bool, error) {
+		if product == "b" {
+			return false, errors.New("down")
+		}
+
+		return true, nil
+	}
+
+	ctx, parent := Tracer().Start(context.Background(), "test")
+
+	_, err := ParseCSV(file_path, saver, mongo.Collection{}, ctx, ImportJob{Source: "https://feeds.example.com/spans.csv"})
+
+	parent.End()
+
+	require.ErrorIs(t, err, ErrStore)
+
+	spans := exporter.GetSpans()
+
+	parse := findSpan(t, spans, "import.parse")
+	store := findSpan(t, spans, "import.store")
+
+	require.Equal(t, parent.SpanContext().SpanID(), parse.Parent.SpanID())
+	require.Equal(t, parent.SpanContext().SpanID(), store.Parent.SpanID())
+
+	require.Equal(t, otelcodes.Unset, parse.Status.Code)
+	require.Equal(t, otelcodes.Error, store.Status.Code)
+	require.Contains(t, parse.Attributes, attribute.Int("rows", 2))
+	require.Contains(t, store.Attributes, attribute.Int64("rows_changed", 1))
+}
+
+func TestDownloadFileSpan(t *testing.T) {
+	exporter := recordSpans(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PRODUCT NAME;PRICE\na;1\n"))
+	}))
+
+	defer ts.Close()
+
+	file_paths, err := DownloadFile(context.Background(), ts.URL+"/products.csv?token=1", "", filepath.Join(t.TempDir(), "feed.csv"), nil)
+
+	require.NoError(t, err)
+
+	defer DeleteFiles(file_paths)
+
+	download := findSpan(t, exporter.GetSpans(), "import.download")
+
+	require.Contains(t, download.Attributes, attribute.String("source", ts.URL+"/products.csv"))
+	require.Contains(t, download.Attributes, attribute.Int("bytes", 23))
+	require.Contains(t, download.Attributes, attribute.Int("files", 1))
+}
+
+func TestTracingContinuesClientTrace(t *testing.T) {
+	exporter := recordSpans(t)
+
+	listener := bufconn.Listen(1 << 20)
+
+	s := grpc.NewServer(TracingServerOption())
+
+	healthpb.RegisterHealthServer(s, health.NewServer())
+
+	go s.Serve(listener)
+
+	defer s.Stop()
+
+	dialer := func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dialer), grpc.WithInsecure(), grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	ctx, client_span := Tracer().Start(context.Background(), "client")
+
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+
+	client_span.End()
+
+	require.NoError(t, err)
+
+	s.Stop()
+
+	var server_span tracetest.SpanStub
+
+	for _, span := range exporter.GetSpans() {
+		if span.SpanKind == trace.SpanKindServer {
+			server_span = span
+		}
+	}
+
+	require.Equal(t, "grpc.health.v1.Health/Check", server_span.Name)
+	require.True(t, server_span.Parent.IsRemote())
+	require.Equal(t, client_span.SpanContext().TraceID(), server_span.SpanContext.TraceID())
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/pkg/sftp"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_S3_REGION = "us-east-1"
+	DEFAULT_SFTP_PORT = "22"
+
+	ERROR_UNSUPPORTED_SCHEME = "Unsupported URL scheme"
+	ERROR_FILE_ROOT          = "File is outside of the feed directory"
+	ERROR_FILE_HOST          = "File URLs may only refer to localhost"
+	ERROR_CREDENTIAL_NEEDED  = "Credential is required for"
+)
+
+var file_root = ""
+var sftp_known_hosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+var s3_endpoint = ""
+var s3_region = DEFAULT_S3_REGION
+
+// transports is rebuilt by main once flags are parsed
+var transports = map[string]Transport{
+	"http":  HTTPTransport{},
+	"https": HTTPTransport{},
+}
+
+// Transport fetches the raw content of a feed from one kind of storage. When
+// state is given the transport should skip the transfer if its validators
+// show the feed is unchanged.
+type Transport interface {
+	Download(ctx context.Context, feed_url *url.URL, credential string, state *SourceState) (*Download, error)
+}
+
+// Download is a feed as it came from the transport, still compressed
+type Download struct {
+	Body            []byte
+	ContentEncoding string
+	ETag            string
+	LastModified    string
+	NotModified     bool
+}
+
+// RegisterTransports enables the transports configured by flags. file://
+// needs --file_root, sftp:// and s3:// are always available but, like every
+// other scheme, still have to be listed in --allowed_schemes.
+func RegisterTransports() map[string]Transport {
+	registered := map[string]Transport{
+		"http":  HTTPTransport{},
+		"https": HTTPTransport{},
+		"sftp":  SFTPTransport{KnownHosts: sftp_known_hosts},
+		"s3":    S3Transport{Endpoint: s3_endpoint, Region: s3_region},
+	}
+
+	if file_root != "" {
+		registered["file"] = FileTransport{Root: file_root}
+	}
+
+	return registered
+}
+
+// DownloadFeed picks the transport by URL scheme and downloads the feed
+func DownloadFeed(ctx context.Context, raw_url string, credential string, state *SourceState) (*Download, error) {
+	feed_url, err := url.Parse(raw_url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := strings.ToLower(feed_url.Scheme)
+
+	if !url_policy.SchemeAllowed(scheme) {
+		return nil, &PolicyError{ERROR_FORBIDDEN_SCHEME, scheme}
+	}
+
+	transport, ok := transports[scheme]
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", ERROR_UNSUPPORTED_SCHEME, scheme)
+	}
+
+	return transport.Download(ctx, feed_url, credential, state)
+}
+
+type HTTPTransport struct{}
+
+func (HTTPTransport) Download(ctx context.Context, feed_url *url.URL, credential string, state *SourceState) (*Download, error) {
+	fetcher, err := FetcherFor(credential)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prepare := func(request *http.Request) {
+		if state != nil {
+			SetConditionalHeaders(request, state)
+		}
+	}
+
+	resp, body, err := fetcher.Get(ctx, feed_url.String(), prepare)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Download{
+		Body:            body,
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		ETag:            resp.Header.Get("ETag"),
+		LastModified:    resp.Header.Get("Last-Modified"),
+		NotModified:     resp.StatusCode == http.StatusNotModified,
+	}, nil
+}
+
+// FileTransport reads feeds from a local directory, typically a volume
+// shared with the supplier's upload job. Nothing outside Root is readable,
+// symlinks included.
+type FileTransport struct {
+	Root string
+}
+
+func (t FileTransport) Download(ctx context.Context, feed_url *url.URL, credential string, state *SourceState) (*Download, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if feed_url.Host != "" && feed_url.Host != "localhost" {
+		return nil, &PolicyError{ERROR_FILE_HOST, feed_url.Host}
+	}
+
+	file_path, err := t.Resolve(feed_url.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(file_path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadFeedFile(file, info.Size(), info.ModTime(), state)
+}
+
+// Resolve maps a URL path onto the file system and makes sure the result,
+// after following symlinks, stays under Root.
+func (t FileTransport) Resolve(url_path string) (string, error) {
+	root, err := filepath.EvalSymlinks(t.Root)
+
+	if err != nil {
+		return "", err
+	}
+
+	root, err = filepath.Abs(root)
+
+	if err != nil {
+		return "", err
+	}
+
+	file_path := filepath.Clean(filepath.FromSlash(url_path))
+
+	if !filepath.IsAbs(file_path) {
+		file_path = filepath.Join(root, file_path)
+	}
+
+	file_path, err = filepath.EvalSymlinks(file_path)
+
+	if err != nil {
+		return "", err
+	}
+
+	relative, err := filepath.Rel(root, file_path)
+
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", &PolicyError{ERROR_FILE_ROOT, url_path}
+	}
+
+	return file_path, nil
+}
+
+// SFTPTransport downloads feeds over SSH. Server keys are verified against
+// KnownHosts and a credential with a password or private key is required.
+type SFTPTransport struct {
+	KnownHosts string
+}
+
+func (t SFTPTransport) Download(ctx context.Context, feed_url *url.URL, credential_name string, state *SourceState) (*Download, error) {
+	err := url_policy.CheckURL(feed_url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := CredentialFor(credential_name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credential == nil {
+		return nil, fmt.Errorf("%s %s", ERROR_CREDENTIAL_NEEDED, feed_url.Scheme)
+	}
+
+	err = credential.CheckHost(feed_url.Hostname())
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := t.ClientConfig(credential)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port := feed_url.Port()
+
+	if port == "" {
+		port = DEFAULT_SFTP_PORT
+	}
+
+	address := net.JoinHostPort(feed_url.Hostname(), port)
+
+	dialer := &net.Dialer{
+		Timeout: connect_timeout,
+		Control: url_policy.Control,
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// the whole session, handshake included, has to fit into read_timeout
+	// and the caller's deadline
+	deadline := time.Now().Add(read_timeout)
+
+	if ctx_deadline, ok := ctx.Deadline(); ok && ctx_deadline.Before(deadline) {
+		deadline = ctx_deadline
+	}
+
+	err = conn.SetDeadline(deadline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// closing the connection is the only way to interrupt ssh and sftp
+	finished := make(chan struct{})
+
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	ssh_conn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ssh_client := ssh.NewClient(ssh_conn, channels, requests)
+
+	defer ssh_client.Close()
+
+	client, err := sftp.NewClient(ssh_client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	file, err := client.Open(feed_url.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadFeedFile(file, info.Size(), info.ModTime(), state)
+}
+
+func (t SFTPTransport) ClientConfig(credential *Credential) (*ssh.ClientConfig, error) {
+	host_keys, err := knownhosts.New(t.KnownHosts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []ssh.AuthMethod
+
+	if credential.PrivateKey != "" {
+		data, err := ioutil.ReadFile(credential.PrivateKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if credential.Password != "" {
+		methods = append(methods, ssh.Password(credential.Password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            credential.Username,
+		Auth:            methods,
+		HostKeyCallback: host_keys,
+		Timeout:         connect_timeout,
+	}, nil
+}
+
+// S3Transport reads s3://bucket/key objects. Endpoint points it at an S3
+// compatible service such as MinIO, buckets are then addressed path style.
+// Without a credential requests are anonymous, the server's own AWS
+// identity is never lent to callers.
+type S3Transport struct {
+	Endpoint string
+	Region   string
+}
+
+func (t S3Transport) Download(ctx context.Context, feed_url *url.URL, credential_name string, state *SourceState) (*Download, error) {
+	bucket := feed_url.Host
+	key := strings.TrimPrefix(feed_url.Path, "/")
+
+	if !url_policy.HostAllowed(strings.ToLower(bucket)) {
+		return nil, &PolicyError{ERROR_FORBIDDEN_HOST, bucket}
+	}
+
+	credential, err := CredentialFor(credential_name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := aws.NewConfig().
+		WithRegion(t.Region).
+		WithMaxRetries(fetch_retries).
+		WithHTTPClient(NewS3Client(url_policy, t.Endpoint)).
+		WithCredentials(credentials.AnonymousCredentials)
+
+	if t.Endpoint != "" {
+		config = config.WithEndpoint(t.Endpoint).WithS3ForcePathStyle(true)
+	}
+
+	if credential != nil {
+		err = credential.CheckHost(bucket)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config = config.WithCredentials(credentials.NewStaticCredentials(credential.AccessKey, credential.SecretKey, ""))
+	}
+
+	aws_session, err := session.NewSession(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	if state != nil && state.ETag != "" {
+		input.IfNoneMatch = aws.String(state.ETag)
+	}
+
+	object, err := s3.New(aws_session).GetObjectWithContext(ctx, input)
+
+	if err != nil {
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			if failure.StatusCode() == http.StatusNotModified {
+				return &Download{NotModified: true}, nil
+			}
+
+			return nil, &StatusError{failure.StatusCode(), fmt.Sprintf("%d %s", failure.StatusCode(), failure.Code())}
+		}
+
+		return nil, err
+	}
+
+	defer object.Body.Close()
+
+	body, err := ReadBody(object.Body, aws.Int64Value(object.ContentLength), max_body_size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Download{
+		Body:            body,
+		ContentEncoding: aws.StringValue(object.ContentEncoding),
+		ETag:            aws.StringValue(object.ETag),
+		LastModified:    FormatModTime(aws.TimeValue(object.LastModified)),
+	}, nil
+}
+
+// NewS3Client dials through policy like the Fetcher does, S3 hosts are
+// derived from the bucket a caller names. Only endpoint, set by the
+// operator with --s3_endpoint, is reached without the policy, it usually
+// lives on a private network.
+func NewS3Client(policy *URLPolicy, endpoint string) *http.Client {
+	policy_dialer := &net.Dialer{
+		Timeout: connect_timeout,
+		Control: policy.Control,
+	}
+
+	endpoint_dialer := &net.Dialer{
+		Timeout: connect_timeout,
+	}
+
+	endpoint_address := EndpointAddress(endpoint)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			if endpoint_address != "" && address == endpoint_address {
+				return endpoint_dialer.DialContext(ctx, network, address)
+			}
+
+			return policy_dialer.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout: connect_timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       read_timeout,
+		CheckRedirect: CheckRedirects(policy, max_redirects, nil),
+	}
+}
+
+// EndpointAddress is the host:port dialed for endpoint, empty when there is
+// no endpoint
+func EndpointAddress(endpoint string) string {
+	endpoint_url, err := url.Parse(endpoint)
+
+	if endpoint == "" || err != nil || endpoint_url.Hostname() == "" {
+		return ""
+	}
+
+	port := endpoint_url.Port()
+
+	if port == "" {
+		port = "443"
+
+		if strings.EqualFold(endpoint_url.Scheme, "http") {
+			port = "80"
+		}
+	}
+
+	return net.JoinHostPort(endpoint_url.Hostname(), port)
+}
+
+// ReadFeedFile is shared by transports that see a plain file with a
+// modification time, which doubles as the Last-Modified validator.
+func ReadFeedFile(reader io.Reader, size int64, mod_time time.Time, state *SourceState) (*Download, error) {
+	last_modified := FormatModTime(mod_time)
+
+	if state != nil && state.LastModified == last_modified {
+		return &Download{NotModified: true}, nil
+	}
+
+	body, err := ReadBody(reader, size, max_body_size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Download{Body: body, LastModified: last_modified}, nil
+}
+
+func FormatModTime(mod_time time.Time) string {
+	if mod_time.IsZero() {
+		return ""
+	}
+
+	return mod_time.UTC().Format(http.TimeFormat)
+}
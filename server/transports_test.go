@@ -0,0 +1,315 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"github.com/pkg/sftp"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withCredentials(t *testing.T, credentials map[string]*Credential) func() {
+	previous := feed_credentials
+	feed_credentials = credentials
+
+	return func() {
+		feed_credentials = previous
+	}
+}
+
+func parseURL(t *testing.T, raw string) *url.URL {
+	feed_url, err := url.Parse(raw)
+	require.NoError(t, err)
+
+	return feed_url
+}
+
+func TestFileTransport(t *testing.T) {
+	sample := readSample(t)
+
+	root := t.TempDir()
+	file_path := filepath.Join(root, "products.csv")
+
+	require.NoError(t, ioutil.WriteFile(file_path, sample, 0600))
+
+	transport := FileTransport{Root: root}
+
+	download, err := transport.Download(context.Background(), parseURL(t, "file://"+filepath.ToSlash(file_path)), "", nil)
+
+	require.NoError(t, err)
+	require.Equal(t, sample, download.Body)
+	require.NotEmpty(t, download.LastModified)
+
+	download, err = transport.Download(context.Background(), parseURL(t, "file://"+filepath.ToSlash(file_path)), "", &SourceState{LastModified: download.LastModified})
+
+	require.NoError(t, err)
+	require.True(t, download.NotModified)
+}
+
+func TestFileTransportStaysInsideRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	secret := filepath.Join(outside, "secret.csv")
+	require.NoError(t, ioutil.WriteFile(secret, []byte("PRODUCT NAME;PRICE\n"), 0600))
+	require.NoError(t, os.Symlink(secret, filepath.Join(root, "link.csv")))
+
+	transport := FileTransport{Root: root}
+
+	var policy_error *PolicyError
+
+	for _, raw := range []string{
+		"file://" + filepath.ToSlash(secret),
+		"file://" + filepath.ToSlash(root) + "/../" + filepath.Base(outside) + "/secret.csv",
+		"file://" + filepath.ToSlash(filepath.Join(root, "link.csv")),
+	} {
+		_, err := transport.Download(context.Background(), parseURL(t, raw), "", nil)
+
+		require.True(t, errors.As(err, &policy_error), "%s: %v", raw, err)
+	}
+
+	_, err := transport.Download(context.Background(), parseURL(t, "file://remote.host/products.csv"), "", nil)
+
+	require.True(t, errors.As(err, &policy_error))
+}
+
+func TestDownloadFeedChecksScheme(t *testing.T) {
+	_, err := DownloadFeed(context.Background(), "gopher://example.com/products.csv", "", nil)
+
+	var policy_error *PolicyError
+
+	require.True(t, errors.As(err, &policy_error))
+
+	// allowed by the test policy but not registered without --file_root
+	_, err = DownloadFeed(context.Background(), "file:///tmp/products.csv", "", nil)
+
+	require.EqualError(t, err, ERROR_UNSUPPORTED_SCHEME+": file")
+}
+
+func TestS3Transport(t *testing.T) {
+	sample := readSample(t)
+
+	var authorization string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+
+		if r.URL.Path != "/feeds/daily/products.csv" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write(sample)
+	}))
+
+	defer ts.Close()
+
+	defer withCredentials(t, map[string]*Credential{
+		"minio": {Hosts: []string{"feeds"}, AccessKey: "AKIDEXAMPLE", SecretKey: "secret"},
+	})()
+
+	transport := S3Transport{Endpoint: ts.URL, Region: DEFAULT_S3_REGION}
+
+	download, err := transport.Download(context.Background(), parseURL(t, "s3://feeds/daily/products.csv"), "minio", nil)
+
+	require.NoError(t, err)
+	require.Equal(t, sample, download.Body)
+	require.Equal(t, `"v1"`, download.ETag)
+	require.True(t, strings.Contains(authorization, "Credential=AKIDEXAMPLE/"), authorization)
+
+	download, err = transport.Download(context.Background(), parseURL(t, "s3://feeds/daily/products.csv"), "", &SourceState{ETag: `"v1"`})
+
+	require.NoError(t, err)
+	require.True(t, download.NotModified)
+	require.Empty(t, authorization)
+
+	_, err = transport.Download(context.Background(), parseURL(t, "s3://feeds/missing.csv"), "", nil)
+
+	var status_error *StatusError
+
+	require.True(t, errors.As(err, &status_error), "%v", err)
+	require.Equal(t, http.StatusNotFound, status_error.StatusCode)
+
+	_, err = transport.Download(context.Background(), parseURL(t, "s3://other/daily/products.csv"), "minio", nil)
+
+	var policy_error *PolicyError
+
+	require.True(t, errors.As(err, &policy_error))
+}
+
+func TestS3ClientChecksAddressAtDialTime(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	defer ts.Close()
+
+	policy := MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", DEFAULT_BLOCKED_NETWORKS)
+
+	// a bucket host resolving to a private address is refused
+	_, err := NewS3Client(policy, "http://minio:9000").Get(ts.URL)
+
+	require.ErrorContains(t, err, ERROR_FORBIDDEN_ADDRESS)
+
+	// the configured endpoint is trusted
+	response, err := NewS3Client(policy, ts.URL).Get(ts.URL)
+
+	require.NoError(t, err)
+	response.Body.Close()
+
+	require.Equal(t, "", EndpointAddress(""))
+	require.Equal(t, "minio:9000", EndpointAddress("http://minio:9000"))
+	require.Equal(t, "s3.example.com:443", EndpointAddress("https://s3.example.com"))
+}
+
+func TestSFTPTransport(t *testing.T) {
+	sample := readSample(t)
+
+	directory := t.TempDir()
+	file_path := filepath.Join(directory, "products.csv")
+
+	require.NoError(t, ioutil.WriteFile(file_path, sample, 0600))
+
+	address, host_key := startSFTPServer(t, "atlant", "secret")
+
+	known_hosts := filepath.Join(directory, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, host_key)
+
+	require.NoError(t, ioutil.WriteFile(known_hosts, []byte(line+"\n"), 0600))
+
+	defer withCredentials(t, map[string]*Credential{
+		"supplier": {Hosts: []string{"127.0.0.1"}, Username: "atlant", Password: "secret"},
+		"wrong":    {Hosts: []string{"127.0.0.1"}, Username: "atlant", Password: "guess"},
+	})()
+
+	transport := SFTPTransport{KnownHosts: known_hosts}
+	feed_url := parseURL(t, "sftp://"+address+filepath.ToSlash(file_path))
+
+	download, err := transport.Download(context.Background(), feed_url, "supplier", nil)
+
+	require.NoError(t, err)
+	require.Equal(t, sample, download.Body)
+
+	download, err = transport.Download(context.Background(), feed_url, "supplier", &SourceState{LastModified: download.LastModified})
+
+	require.NoError(t, err)
+	require.True(t, download.NotModified)
+
+	_, err = transport.Download(context.Background(), feed_url, "wrong", nil)
+
+	require.Error(t, err)
+
+	_, err = transport.Download(context.Background(), feed_url, "", nil)
+
+	require.Error(t, err)
+
+	// unknown host key
+	require.NoError(t, ioutil.WriteFile(known_hosts, []byte{}, 0600))
+
+	_, err = transport.Download(context.Background(), feed_url, "supplier", nil)
+
+	require.Error(t, err)
+}
+
+// startSFTPServer serves the local file system over SFTP on a random port
+func startSFTPServer(t *testing.T, user string, password string) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if conn.User() == user && string(given) == password {
+				return nil, nil
+			}
+
+			return nil, errors.New("access denied")
+		},
+	}
+
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	t.Cleanup(func() { listener.Close() })
+
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for new_channel := range channels {
+		if new_channel.ChannelType() != "session" {
+			new_channel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+
+		channel, channel_requests, err := new_channel.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for request := range channel_requests {
+				is_sftp := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+
+				request.Reply(is_sftp, nil)
+
+				if is_sftp {
+					server, err := sftp.NewServer(channel)
+
+					if err == nil {
+						server.Serve()
+					}
+
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DB_PRICE_CHANGES_COLLECTION_NAME = "price_changes"
+
+	// DEFAULT_PRICE_CHANGES_TTL is how long price changes are kept, watchers
+	// only get the ones made while they watch
+	DEFAULT_PRICE_CHANGES_TTL = 24 * time.Hour
+
+	// WATCH_BUFFER is how far a watcher of this instance may fall behind
+	// before its stream is ended
+	WATCH_BUFFER = 1024
+
+	// CHANGE_STREAMS_UNSUPPORTED is the MongoDB error code for change
+	// streams on a server that is not a replica set
+	CHANGE_STREAMS_UNSUPPORTED = 40573
+
+	ERROR_PRODUCT_PATTERN = "Invalid product pattern"
+	ERROR_WATCH_THRESHOLD = "Thresholds must not be negative"
+	ERROR_WATCH_STOPPED   = "Price change stream stopped, watch again to go on"
+)
+
+var db_price_changes_collection_name = DEFAULT_DB_PRICE_CHANGES_COLLECTION_NAME
+var price_changes_ttl = DEFAULT_PRICE_CHANGES_TTL
+
+// price_changes passes the changes of this instance to its watchers when
+// MongoDB has no change streams
+var price_changes = NewPriceChangeHub()
+
+// price_change_indexes remembers the databases whose TTL index exists
+var price_change_indexes sync.Map
+
+// watchers_context ends the watch streams when the server drains, they
+// would hold up GracefulStop otherwise
+var watchers_context, stop_watchers = context.WithCancel(context.Background())
+
+// PriceChange is a product an import added or repriced. Changes are kept
+// for price_changes_ttl, removed by a TTL index on expiresat.
+type PriceChange struct {
+	Product   string
+	OldPrice  float64
+	NewPrice  float64
+	Added     bool
+	Source    string
+	ImportId  string
+	Time      time.Time
+	ExpiresAt time.Time
+}
+
+func PriceChangesCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_price_changes_collection_name)
+}
+
+// RecordPriceChange saves a change next to the products collection it was
+// made to, where change streams pick it up, and passes it to the watchers
+// of this instance
+func RecordPriceChange(collection mongo.Collection, mng_context context.Context, change PriceChange) error {
+	database := collection.Database()
+	changes := database.Collection(db_price_changes_collection_name)
+
+	if _, ok := price_change_indexes.Load(database.Name()); !ok {
+		index := mongo.IndexModel{
+			Keys:    bson.M{"expiresat": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}
+
+		if _, err := changes.Indexes().CreateOne(mng_context, index); err != nil {
+			return err
+		}
+
+		price_change_indexes.Store(database.Name(), true)
+	}
+
+	change.ExpiresAt = change.Time.Add(price_changes_ttl)
+
+	if _, err := changes.InsertOne(mng_context, change); err != nil {
+		return err
+	}
+
+	price_changes.Publish(database.Name(), change)
+
+	return nil
+}
+
+// NotifyPriceChange records a change job made, the product is saved even
+// when the change cannot be
+func NotifyPriceChange(collection mongo.Collection, mng_context context.Context, change PriceChange, job ImportJob) {
+	change.Source = job.Source
+	change.ImportId = job.Id
+	change.Time = time.Now()
+
+	if err := RecordPriceChange(collection, mng_context, change); err != nil {
+		slog.WarnContext(mng_context, "Cannot record price change", "product", change.Product, "error", err)
+	}
+}
+
+// PriceChangeHub hands the changes saved by this instance to its watchers
+type PriceChangeHub struct {
+	mutex    sync.Mutex
+	watchers map[chan PriceChange]string
+}
+
+func NewPriceChangeHub() *PriceChangeHub {
+	return &PriceChangeHub{watchers: map[chan PriceChange]string{}}
+}
+
+// Subscribe returns the changes published for database from now on and a
+// function to stop. The channel is closed when the watcher falls
+// WATCH_BUFFER changes behind.
+func (h *PriceChangeHub) Subscribe(database string) (<-chan PriceChange, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	events := make(chan PriceChange, WATCH_BUFFER)
+
+	h.watchers[events] = database
+
+	stop := func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		if _, ok := h.watchers[events]; ok {
+			delete(h.watchers, events)
+			close(events)
+		}
+	}
+
+	return events, stop
+}
+
+// Publish never blocks the import, watchers that cannot keep up are dropped
+func (h *PriceChangeHub) Publish(database string, change PriceChange) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for events, name := range h.watchers {
+		if name != database {
+			continue
+		}
+
+		select {
+		case events <- change:
+		default:
+			slog.Warn("Price change watcher fell behind", "database", database, "buffer", WATCH_BUFFER)
+
+			delete(h.watchers, events)
+			close(events)
+		}
+	}
+}
+
+func ChangeStreamsUnsupported(err error) bool {
+	var command_error mongo.CommandError
+
+	return errors.As(err, &command_error) && command_error.Code == CHANGE_STREAMS_UNSUPPORTED
+}
+
+// WatchChanges returns the changes inserted into collection from now on
+// and a function to stop. They come from a change stream, so the imports
+// of every instance are seen, or from price_changes when MongoDB is not a
+// replica set. The channel is closed when the stream fails.
+func WatchChanges(collection mongo.Collection, mng_context context.Context) (<-chan PriceChange, func(), error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+
+	stream, err := collection.Watch(mng_context, pipeline)
+
+	if ChangeStreamsUnsupported(err) {
+		slog.DebugContext(mng_context, "MongoDB has no change streams, watching the imports of this instance")
+
+		events, stop := price_changes.Subscribe(collection.Database().Name())
+
+		return events, stop, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream_context, cancel := context.WithCancel(mng_context)
+	events := make(chan PriceChange, WATCH_BUFFER)
+
+	go func() {
+		defer close(events)
+		defer stream.Close(context.Background())
+
+		for stream.Next(stream_context) {
+			var event struct {
+				FullDocument PriceChange `bson:"fullDocument"`
+			}
+
+			if err := stream.Decode(&event); err != nil {
+				slog.WarnContext(mng_context, "Cannot decode price change", "error", err)
+
+				return
+			}
+
+			select {
+			case events <- event.FullDocument:
+			case <-stream_context.Done():
+				return
+			}
+		}
+
+		if err := stream.Err(); err != nil && stream_context.Err() == nil {
+			slog.WarnContext(mng_context, "Price change stream failed", "error", err)
+		}
+	}()
+
+	return events, cancel, nil
+}
+
+// PriceChangeFilter keeps the changes a watcher asked for
+type PriceChangeFilter struct {
+	Product          *regexp.Regexp
+	MinChange        float64
+	MinChangePercent float64
+	Source           string
+}
+
+func NewPriceChangeFilter(in *api.WatchPriceChangesRequest) (PriceChangeFilter, error) {
+	filter := PriceChangeFilter{
+		MinChange:        in.GetMinChange(),
+		MinChangePercent: in.GetMinChangePercent(),
+		Source:           in.GetSource(),
+	}
+
+	if filter.MinChange < 0 || filter.MinChangePercent < 0 {
+		return filter, fmt.Errorf("%s", ERROR_WATCH_THRESHOLD)
+	}
+
+	if in.GetProductPattern() != "" {
+		pattern, err := regexp.Compile(in.GetProductPattern())
+
+		if err != nil {
+			return filter, fmt.Errorf("%s: %v", ERROR_PRODUCT_PATTERN, err)
+		}
+
+		filter.Product = pattern
+	}
+
+	return filter, nil
+}
+
+// Match tells whether the watcher wants change, added products pass the
+// thresholds and so do repriced ones that were free
+func (f PriceChangeFilter) Match(change PriceChange) bool {
+	if f.Source != "" && change.Source != f.Source {
+		return false
+	}
+
+	if f.Product != nil && !f.Product.MatchString(change.Product) {
+		return false
+	}
+
+	if change.Added {
+		return true
+	}
+
+	difference := math.Abs(change.NewPrice - change.OldPrice)
+
+	if difference < f.MinChange {
+		return false
+	}
+
+	if change.OldPrice != 0 && difference*100 < f.MinChangePercent*math.Abs(change.OldPrice) {
+		return false
+	}
+
+	return true
+}
+
+func PriceChangeToApi(change PriceChange) *api.PriceChange {
+	return &api.PriceChange{
+		Product:  change.Product,
+		OldPrice: change.OldPrice,
+		NewPrice: change.NewPrice,
+		Added:    change.Added,
+		Source:   change.Source,
+		ImportId: change.ImportId,
+		Time:     timestamppb.New(change.Time),
+	}
+}
+
+// WatchPriceChanges sends the changes matching in until the caller goes
+// away or the server drains
+func (s *server) WatchPriceChanges(in *api.WatchPriceChangesRequest, stream api.Api_WatchPriceChangesServer) error {
+	ctx := stream.Context()
+
+	filter, err := NewPriceChangeFilter(in)
+
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(context.Background())
+
+	changes, stop, err := WatchChanges(PriceChangesCollection(client, TenantFromContext(ctx)), ctx)
+
+	if err != nil {
+		return StoreError(ctx, err)
+	}
+
+	defer stop()
+
+	slog.InfoContext(ctx, "Watching price changes", "product_pattern", in.GetProductPattern(), "min_change", in.GetMinChange(), "min_change_percent", in.GetMinChangePercent(), "source", in.GetSource())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-watchers_context.Done():
+			return status.Error(codes.Unavailable, ERROR_SHUTTING_DOWN)
+		case change, ok := <-changes:
+			if !ok {
+				return status.Error(codes.Unavailable, ERROR_WATCH_STOPPED)
+			}
+
+			if !filter.Match(change) {
+				continue
+			}
+
+			if err := stream.Send(PriceChangeToApi(change)); err != nil {
+				return err
+			}
+		}
+	}
+}
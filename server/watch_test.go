@@ -0,0 +1,117 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPriceChangeFilter(t *testing.T) {
+	filter, err := NewPriceChangeFilter(&api.WatchPriceChangesRequest{ProductPattern: "^phone-", MinChangePercent: 10})
+
+	require.NoError(t, err)
+
+	require.True(t, filter.Match(PriceChange{Product: "phone-1", OldPrice: 100, NewPrice: 89}))
+	require.True(t, filter.Match(PriceChange{Product: "phone-1", OldPrice: 100, NewPrice: 110}))
+	require.False(t, filter.Match(PriceChange{Product: "phone-1", OldPrice: 100, NewPrice: 95}))
+	require.False(t, filter.Match(PriceChange{Product: "case-1", OldPrice: 100, NewPrice: 50}))
+
+	// added products and free ones have no percentage to compare
+	require.True(t, filter.Match(PriceChange{Product: "phone-2", NewPrice: 1, Added: true}))
+	require.True(t, filter.Match(PriceChange{Product: "phone-3", NewPrice: 1}))
+
+	filter, err = NewPriceChangeFilter(&api.WatchPriceChangesRequest{MinChange: 5, Source: "https://supplier-a.com/products.csv"})
+
+	require.NoError(t, err)
+
+	require.True(t, filter.Match(PriceChange{Product: "a", OldPrice: 10, NewPrice: 5, Source: "https://supplier-a.com/products.csv"}))
+	require.False(t, filter.Match(PriceChange{Product: "a", OldPrice: 10, NewPrice: 6, Source: "https://supplier-a.com/products.csv"}))
+	require.False(t, filter.Match(PriceChange{Product: "a", OldPrice: 10, NewPrice: 5, Source: "https://supplier-b.com/products.csv"}))
+
+	_, err = NewPriceChangeFilter(&api.WatchPriceChangesRequest{ProductPattern: "("})
+
+	require.ErrorContains(t, err, ERROR_PRODUCT_PATTERN)
+
+	_, err = NewPriceChangeFilter(&api.WatchPriceChangesRequest{MinChange: -1})
+
+	require.ErrorContains(t, err, ERROR_WATCH_THRESHOLD)
+}
+
+func TestPriceChangeHub(t *testing.T) {
+	hub := NewPriceChangeHub()
+
+	retail, stop := hub.Subscribe("atlant_retail")
+
+	defer stop()
+
+	wholesale, stop_wholesale := hub.Subscribe("atlant_wholesale")
+
+	hub.Publish("atlant_retail", PriceChange{Product: "a", NewPrice: 1})
+
+	require.Equal(t, "a", (<-retail).Product)
+	require.Len(t, wholesale, 0)
+
+	stop_wholesale()
+
+	_, ok := <-wholesale
+
+	require.False(t, ok)
+
+	// a watcher that does not keep up is dropped, the import goes on
+	for i := 0; i <= WATCH_BUFFER; i++ {
+		hub.Publish("atlant_retail", PriceChange{Product: "a", NewPrice: float64(i)})
+	}
+
+	for range retail {
+	}
+
+	hub.Publish("atlant_retail", PriceChange{Product: "b", NewPrice: 1})
+}
+
+func TestSaveResultsRecordsPriceChanges(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, collection := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	product := "test_product_price_changes"
+	job := ImportJob{Id: "price-changes", Source: "https://supplier-a.com/products.csv", Time: time.Now().Unix()}
+
+	changes := PriceChangesCollection(client, DEFAULT_TENANT)
+
+	defer collection.DeleteOne(mng_context, bson.M{"product": product})
+	defer changes.DeleteMany(mng_context, bson.M{"product": product})
+
+	events, stop := price_changes.Subscribe(collection.Database().Name())
+
+	defer stop()
+
+	SaveResults(collection, mng_context, product, 10, job)
+	SaveResults(collection, mng_context, product, 10, job)
+	SaveResults(collection, mng_context, product, 12.5, job)
+
+	added := <-events
+	repriced := <-events
+
+	require.True(t, added.Added)
+	require.Equal(t, 10.0, repriced.OldPrice)
+	require.Equal(t, 12.5, repriced.NewPrice)
+	require.Equal(t, job.Id, repriced.ImportId)
+	require.Len(t, events, 0)
+
+	count, err := changes.CountDocuments(mng_context, bson.M{"product": product})
+
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+}
@@ -0,0 +1,768 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_DB_WEBHOOKS_COLLECTION_NAME           = "webhooks"
+	DEFAULT_DB_WEBHOOK_DELIVERIES_COLLECTION_NAME = "webhook_deliveries"
+
+	DEFAULT_WEBHOOK_INTERVAL   = 10 * time.Second
+	DEFAULT_WEBHOOK_TIMEOUT    = 10 * time.Second
+	DEFAULT_WEBHOOK_RETRIES    = 5
+	DEFAULT_WEBHOOK_BACKOFF    = 30 * time.Second
+	DEFAULT_WEBHOOK_BATCH_SIZE = 500
+	DEFAULT_WEBHOOK_WORKERS    = 8
+
+	// MAX_WEBHOOK_BACKOFF caps the doubling delay between attempts
+	MAX_WEBHOOK_BACKOFF = time.Hour
+
+	WEBHOOK_SECRET_SIZE = 32
+
+	WEBHOOK_DELIVERY_HEADER  = "X-Atlant-Delivery"
+	WEBHOOK_TIMESTAMP_HEADER = "X-Atlant-Timestamp"
+	WEBHOOK_SIGNATURE_HEADER = "X-Atlant-Signature"
+	WEBHOOK_SIGNATURE_PREFIX = "sha256="
+
+	RESULT_DELIVERED = "delivered"
+	RESULT_RETRY     = "retry"
+	RESULT_DEAD      = "dead"
+
+	ERROR_WEBHOOK_URL     = "Webhook URL must be http or https"
+	ERROR_WEBHOOK_ID      = "Incorrect webhook id"
+	ERROR_WEBHOOK_MISSING = "Webhook not found"
+)
+
+var webhook_interval = DEFAULT_WEBHOOK_INTERVAL
+var webhook_timeout = DEFAULT_WEBHOOK_TIMEOUT
+var webhook_retries = DEFAULT_WEBHOOK_RETRIES
+var webhook_backoff = DEFAULT_WEBHOOK_BACKOFF
+var webhook_batch_size = DEFAULT_WEBHOOK_BATCH_SIZE
+var webhook_workers = DEFAULT_WEBHOOK_WORKERS
+
+var db_webhooks_collection_name = DEFAULT_DB_WEBHOOKS_COLLECTION_NAME
+var db_webhook_deliveries_collection_name = DEFAULT_DB_WEBHOOK_DELIVERIES_COLLECTION_NAME
+
+// webhook_client is rebuilt by main once flags are parsed
+var webhook_client = NewWebhookClient(url_policy)
+
+// webhook_slots caps the deliveries this instance sends at once, so a dead
+// endpoint with a backlog does not get all of it each round. It is rebuilt
+// by main once flags are parsed.
+var webhook_slots = NewWebhookSlots(webhook_workers)
+
+// webhook_wakeup makes this instance send the payloads an import just
+// queued instead of waiting for the next tick
+var webhook_wakeup = make(chan struct{}, 1)
+
+// Webhook gets the price changes of every import of the tenant whose
+// database it is stored in
+type Webhook struct {
+	Id           primitive.ObjectID `bson:"_id,omitempty"`
+	Url          string
+	Secret       string
+	LastDelivery int64
+	LastError    string
+}
+
+// WebhookDelivery is a payload waiting for its webhook, or a dead letter
+// once Dead. Payload is kept as first built so every attempt sends the
+// same body.
+type WebhookDelivery struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty"`
+	WebhookId   primitive.ObjectID
+	ImportId    string
+	Changes     int64
+	Payload     []byte
+	Attempts    int32
+	NextAttempt int64
+	LastError   string
+	Dead        bool
+	Created     int64
+}
+
+func WebhooksCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_webhooks_collection_name)
+}
+
+func WebhookDeliveriesCollection(client mongo.Client, tenant string) mongo.Collection {
+	return *TenantDatabase(client, tenant).Collection(db_webhook_deliveries_collection_name)
+}
+
+func (s *server) CreateWebhook(ctx context.Context, in *api.Webhook) (*api.Webhook, error) {
+	webhook, err := WebhookFromApi(in)
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	webhook.Id = primitive.NewObjectID()
+
+	if webhook.Secret == "" {
+		webhook.Secret = NewWebhookSecret()
+	}
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	collection := WebhooksCollection(client, TenantFromContext(ctx))
+
+	_, err = collection.InsertOne(ctx, webhook)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	slog.InfoContext(ctx, "Webhook created", "webhook", webhook.Id.Hex(), "url", SourceLabel(webhook.Url))
+
+	created := WebhookToApi(webhook)
+
+	// the only time the secret is given out
+	created.Secret = webhook.Secret
+
+	return created, nil
+}
+
+func (s *server) DeleteWebhook(ctx context.Context, in *api.DeleteWebhookRequest) (*api.DeleteWebhookResponse, error) {
+	id, err := primitive.ObjectIDFromHex(in.GetId())
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", ERROR_WEBHOOK_ID, in.GetId())
+	}
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	tenant := TenantFromContext(ctx)
+	collection := WebhooksCollection(client, tenant)
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	if result.DeletedCount == 0 {
+		return nil, status.Errorf(codes.NotFound, "%s: %s", ERROR_WEBHOOK_MISSING, in.GetId())
+	}
+
+	deliveries := WebhookDeliveriesCollection(client, tenant)
+
+	_, err = deliveries.DeleteMany(ctx, bson.M{"webhookid": id})
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	slog.InfoContext(ctx, "Webhook deleted", "webhook", in.GetId())
+
+	return &api.DeleteWebhookResponse{}, nil
+}
+
+func (s *server) ListWebhooks(ctx context.Context, in *api.ListWebhooksRequest) (*api.ListWebhooksResponse, error) {
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	webhooks, err := LoadWebhooks(WebhooksCollection(client, TenantFromContext(ctx)), ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	data := make([]*api.Webhook, len(webhooks))
+
+	for i := range webhooks {
+		data[i] = WebhookToApi(webhooks[i])
+	}
+
+	return &api.ListWebhooksResponse{Webhooks: data}, nil
+}
+
+func (s *server) ListDeadLetters(ctx context.Context, in *api.ListDeadLettersRequest) (*api.ListDeadLettersResponse, error) {
+	id, err := primitive.ObjectIDFromHex(in.GetWebhookId())
+
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", ERROR_WEBHOOK_ID, in.GetWebhookId())
+	}
+
+	client, err := ConnectMongo(ctx)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	defer client.Disconnect(ctx)
+
+	collection := WebhookDeliveriesCollection(client, TenantFromContext(ctx))
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}}).SetProjection(bson.M{"payload": 0})
+
+	cursor, err := collection.Find(ctx, bson.M{"webhookid": id, "dead": true}, opts)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	var dead []WebhookDelivery
+
+	err = cursor.All(ctx, &dead)
+
+	if err != nil {
+		return nil, StoreError(ctx, err)
+	}
+
+	data := make([]*api.DeadLetter, len(dead))
+
+	for i := range dead {
+		data[i] = DeadLetterToApi(dead[i])
+	}
+
+	return &api.ListDeadLettersResponse{DeadLetters: data}, nil
+}
+
+// WebhookFromApi validates a webhook coming from a client. Its URL has to
+// pass url_policy like a feed URL, webhooks must not reach internal hosts.
+func WebhookFromApi(in *api.Webhook) (Webhook, error) {
+	webhook := Webhook{
+		Url:    in.GetUrl(),
+		Secret: in.GetSecret(),
+	}
+
+	webhook_url, err := url.Parse(webhook.Url)
+
+	if err != nil {
+		return webhook, err
+	}
+
+	if webhook_url.Scheme != "http" && webhook_url.Scheme != "https" || webhook_url.Host == "" {
+		return webhook, fmt.Errorf("%s: %q", ERROR_WEBHOOK_URL, webhook.Url)
+	}
+
+	if err := url_policy.CheckURL(webhook_url); err != nil {
+		return webhook, err
+	}
+
+	return webhook, nil
+}
+
+// WebhookToApi leaves the secret out
+func WebhookToApi(webhook Webhook) *api.Webhook {
+	return &api.Webhook{
+		Id:           webhook.Id.Hex(),
+		Url:          webhook.Url,
+		LastDelivery: UnixToTimestamp(webhook.LastDelivery),
+		LastError:    webhook.LastError,
+	}
+}
+
+func DeadLetterToApi(delivery WebhookDelivery) *api.DeadLetter {
+	return &api.DeadLetter{
+		Id:        delivery.Id.Hex(),
+		WebhookId: delivery.WebhookId.Hex(),
+		ImportId:  delivery.ImportId,
+		Changes:   delivery.Changes,
+		Attempts:  delivery.Attempts,
+		LastError: delivery.LastError,
+		Created:   UnixToTimestamp(delivery.Created),
+	}
+}
+
+func NewWebhookSecret() string {
+	secret := make([]byte, WEBHOOK_SECRET_SIZE)
+
+	_, err := rand.Read(secret)
+
+	ErrorCheck(err)
+
+	return hex.EncodeToString(secret)
+}
+
+// WebhookSignature signs the timestamp with the body, so receivers can
+// reject old payloads replayed to them
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return WEBHOOK_SIGNATURE_PREFIX + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookClient only talks to the addresses policy permits, like the
+// feed Fetcher, and does not follow redirects
+func NewWebhookClient(policy *URLPolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: connect_timeout,
+		Control: policy.Control,
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: connect_timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   webhook_timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func LoadWebhooks(collection mongo.Collection, mng_context context.Context) ([]Webhook, error) {
+	cursor, err := collection.Find(mng_context, bson.D{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks []Webhook
+
+	err = cursor.All(mng_context, &webhooks)
+
+	return webhooks, err
+}
+
+// WebhookBatches splits the changes of an import into payloads of at most
+// size changes
+func WebhookBatches(changes []PriceChange, size int) [][]PriceChange {
+	var batches [][]PriceChange
+
+	for len(changes) > size && size > 0 {
+		batches = append(batches, changes[:size])
+		changes = changes[size:]
+	}
+
+	if len(changes) > 0 {
+		batches = append(batches, changes)
+	}
+
+	return batches
+}
+
+// NotifyWebhooks queues the changes job made for the webhooks of the
+// tenant, the import succeeds even when they cannot be queued
+func NotifyWebhooks(collection mongo.Collection, mng_context context.Context, job ImportJob) {
+	count, err := QueueWebhooks(collection.Database(), mng_context, job, time.Now())
+
+	if err != nil {
+		slog.WarnContext(mng_context, "Cannot queue webhooks", "import_id", job.Id, "error", err)
+
+		return
+	}
+
+	if count > 0 {
+		slog.DebugContext(mng_context, "Webhooks queued", "import_id", job.Id, "deliveries", count)
+
+		select {
+		case webhook_wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// QueueWebhooks stores a delivery per webhook and batch of the changes job
+// recorded in database and returns how many there are
+func QueueWebhooks(database *mongo.Database, mng_context context.Context, job ImportJob, now time.Time) (int, error) {
+	webhooks, err := LoadWebhooks(*database.Collection(db_webhooks_collection_name), mng_context)
+
+	if err != nil || len(webhooks) == 0 {
+		return 0, err
+	}
+
+	changes := database.Collection(db_price_changes_collection_name)
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+
+	cursor, err := changes.Find(mng_context, bson.M{"importid": job.Id}, opts)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var recorded []PriceChange
+
+	if err := cursor.All(mng_context, &recorded); err != nil {
+		return 0, err
+	}
+
+	tenant, _ := TenantFromDatabaseName(database.Name())
+	batches := WebhookBatches(recorded, webhook_batch_size)
+
+	var deliveries []interface{}
+
+	for _, webhook := range webhooks {
+		for i, batch := range batches {
+			payload := &api.WebhookPayload{
+				DeliveryId: primitive.NewObjectID().Hex(),
+				ImportId:   job.Id,
+				Source:     job.Source,
+				Tenant:     tenant,
+				Batch:      int32(i + 1),
+				Batches:    int32(len(batches)),
+			}
+
+			for _, change := range batch {
+				payload.Changes = append(payload.Changes, PriceChangeToApi(change))
+			}
+
+			body, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(payload)
+
+			if err != nil {
+				return 0, err
+			}
+
+			id, _ := primitive.ObjectIDFromHex(payload.GetDeliveryId())
+
+			deliveries = append(deliveries, WebhookDelivery{
+				Id:          id,
+				WebhookId:   webhook.Id,
+				ImportId:    job.Id,
+				Changes:     int64(len(batch)),
+				Payload:     body,
+				NextAttempt: now.Unix(),
+				Created:     now.Unix(),
+			})
+		}
+	}
+
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+
+	_, err = database.Collection(db_webhook_deliveries_collection_name).InsertMany(mng_context, deliveries)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(deliveries), nil
+}
+
+// RunWebhooks sends due deliveries of all tenants every interval, and
+// right away when an import of this instance queued some. All instances
+// run it, ClaimDelivery makes sure each attempt happens only once.
+func RunWebhooks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhook_wakeup:
+		}
+
+		DeliverDueWebhooks(time.Now())
+	}
+}
+
+func DeliverDueWebhooks(now time.Time) {
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := ConnectMongo(mng_context)
+
+	if err != nil {
+		slog.Error("Cannot look for due webhooks", "error", err)
+		return
+	}
+
+	defer client.Disconnect(mng_context)
+
+	tenants, err := Tenants(client, mng_context)
+
+	if err != nil {
+		slog.Error("Cannot list tenants", "error", err)
+		return
+	}
+
+	for _, tenant := range tenants {
+		DeliverDueTenantWebhooks(client, mng_context, tenant, now)
+	}
+}
+
+func DeliverDueTenantWebhooks(client mongo.Client, mng_context context.Context, tenant string, now time.Time) {
+	deliveries := WebhookDeliveriesCollection(client, tenant)
+
+	// no more than the workers can take, the oldest first
+	opts := options.Find().SetSort(bson.D{{Key: "nextattempt", Value: 1}}).SetLimit(int64(cap(webhook_slots)))
+
+	cursor, err := deliveries.Find(mng_context, bson.M{"dead": false, "nextattempt": bson.M{"$lte": now.Unix()}}, opts)
+
+	if err != nil {
+		slog.Error("Cannot load webhook deliveries", "tenant", tenant, "error", err)
+		return
+	}
+
+	var due []WebhookDelivery
+
+	err = cursor.All(mng_context, &due)
+
+	if err != nil {
+		slog.Error("Cannot load webhook deliveries", "tenant", tenant, "error", err)
+		return
+	}
+
+	if len(due) == 0 {
+		return
+	}
+
+	webhooks, err := LoadWebhooks(WebhooksCollection(client, tenant), mng_context)
+
+	if err != nil {
+		slog.Error("Cannot load webhooks", "tenant", tenant, "error", err)
+		return
+	}
+
+	by_id := map[primitive.ObjectID]Webhook{}
+
+	for _, webhook := range webhooks {
+		by_id[webhook.Id] = webhook
+	}
+
+	for _, delivery := range due {
+		webhook, ok := by_id[delivery.WebhookId]
+
+		if !ok {
+			// the webhook was deleted after its deliveries were loaded
+			if _, err := deliveries.DeleteOne(mng_context, bson.M{"_id": delivery.Id}); err != nil {
+				slog.Error("Cannot delete webhook delivery", "tenant", tenant, "delivery", delivery.Id.Hex(), "error", err)
+			}
+
+			continue
+		}
+
+		select {
+		case webhook_slots <- struct{}{}:
+		default:
+			// the rest waits for the next round
+			return
+		}
+
+		claimed, err := ClaimDelivery(deliveries, mng_context, delivery, now)
+
+		if err != nil {
+			slog.Error("Cannot claim webhook delivery", "delivery", delivery.Id.Hex(), "error", err)
+		}
+
+		if !claimed {
+			<-webhook_slots
+			continue
+		}
+
+		go func(webhook Webhook, delivery WebhookDelivery) {
+			defer func() { <-webhook_slots }()
+
+			DeliverWebhook(tenant, webhook, delivery)
+		}(webhook, delivery)
+	}
+}
+
+// NewWebhookSlots makes room for workers deliveries at once, one at least
+func NewWebhookSlots(workers int) chan struct{} {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return make(chan struct{}, workers)
+}
+
+// ClaimDelivery moves NextAttempt past the attempt only if no other
+// instance did it first. Should this instance die during the attempt, the
+// delivery is tried again once the lease is over.
+func ClaimDelivery(collection mongo.Collection, mng_context context.Context, delivery WebhookDelivery, now time.Time) (bool, error) {
+	lease := now.Add(2 * webhook_timeout)
+
+	filter := bson.M{"_id": delivery.Id, "nextattempt": delivery.NextAttempt, "dead": false}
+	update := bson.M{"$set": bson.M{"nextattempt": lease.Unix()}}
+
+	result, err := collection.UpdateOne(mng_context, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func DeliverWebhook(tenant string, webhook Webhook, delivery WebhookDelivery) {
+	ctx := WithRpcRequestId(WithTenant(context.Background(), tenant), NewRpcRequestId())
+
+	ctx, span := Tracer().Start(ctx, "webhook.deliver", trace.WithAttributes(
+		attribute.String("webhook", webhook.Id.Hex()),
+		attribute.String("delivery", delivery.Id.Hex()),
+		attribute.Int("attempt", int(delivery.Attempts)+1),
+	))
+
+	err := SendWebhook(ctx, webhook_client, webhook, delivery, time.Now())
+
+	EndSpan(span, err)
+
+	if err != nil {
+		slog.WarnContext(ctx, "Webhook delivery failed", "webhook", webhook.Id.Hex(), "delivery", delivery.Id.Hex(), "attempt", delivery.Attempts+1, "error", err)
+	}
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, store_err := ConnectMongo(mng_context)
+
+	if store_err == nil {
+		defer client.Disconnect(mng_context)
+
+		var result string
+
+		result, store_err = RecordDelivery(WebhookDeliveriesCollection(client, tenant), WebhooksCollection(client, tenant), mng_context, delivery, err, time.Now())
+
+		if store_err == nil {
+			webhook_deliveries.WithLabelValues(result).Inc()
+		}
+
+		if result == RESULT_DEAD {
+			slog.ErrorContext(ctx, "Webhook delivery moved to dead letters", "webhook", webhook.Id.Hex(), "delivery", delivery.Id.Hex(), "import_id", delivery.ImportId)
+		}
+	}
+
+	if store_err != nil {
+		slog.ErrorContext(ctx, "Cannot record webhook delivery", "delivery", delivery.Id.Hex(), "error", store_err)
+	}
+}
+
+// SendWebhook POSTs the payload of delivery, any status outside of 2xx is
+// a failure
+func SendWebhook(ctx context.Context, client *http.Client, webhook Webhook, delivery WebhookDelivery, now time.Time) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(delivery.Payload))
+
+	if err != nil {
+		return err
+	}
+
+	timestamp := now.Unix()
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WEBHOOK_DELIVERY_HEADER, delivery.Id.Hex())
+	request.Header.Set(WEBHOOK_TIMESTAMP_HEADER, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(WEBHOOK_SIGNATURE_HEADER, WebhookSignature(webhook.Secret, timestamp, delivery.Payload))
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return UnwrapURLError(err)
+	}
+
+	defer response.Body.Close()
+
+	// read a little so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 4096))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &StatusError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	return nil
+}
+
+// WebhookBackoff is the delay before the attempt after attempts failed
+// ones, doubling from webhook_backoff
+func WebhookBackoff(attempts int32) time.Duration {
+	backoff := webhook_backoff
+
+	for i := int32(1); i < attempts && backoff < MAX_WEBHOOK_BACKOFF; i++ {
+		backoff *= 2
+	}
+
+	if backoff > MAX_WEBHOOK_BACKOFF {
+		return MAX_WEBHOOK_BACKOFF
+	}
+
+	return backoff
+}
+
+// RecordDelivery removes a delivered payload. A failed one is tried again
+// after WebhookBackoff, or kept as a dead letter once webhook_retries
+// retries failed.
+func RecordDelivery(deliveries mongo.Collection, webhooks mongo.Collection, mng_context context.Context, delivery WebhookDelivery, send_err error, now time.Time) (string, error) {
+	if send_err == nil {
+		if _, err := deliveries.DeleteOne(mng_context, bson.M{"_id": delivery.Id}); err != nil {
+			return "", err
+		}
+
+		_, err := webhooks.UpdateOne(mng_context, bson.M{"_id": delivery.WebhookId}, bson.M{"$set": bson.M{"lastdelivery": now.Unix(), "lasterror": ""}})
+
+		return RESULT_DELIVERED, err
+	}
+
+	attempts := delivery.Attempts + 1
+	last_error := send_err.Error()
+
+	update := bson.M{"attempts": attempts, "lasterror": last_error}
+	result := RESULT_RETRY
+
+	if int(attempts) > webhook_retries {
+		update["dead"] = true
+		result = RESULT_DEAD
+	} else {
+		update["nextattempt"] = now.Add(WebhookBackoff(attempts)).Unix()
+	}
+
+	if _, err := deliveries.UpdateOne(mng_context, bson.M{"_id": delivery.Id}, bson.M{"$set": update}); err != nil {
+		return "", err
+	}
+
+	_, err := webhooks.UpdateOne(mng_context, bson.M{"_id": delivery.WebhookId}, bson.M{"$set": bson.M{"lasterror": last_error}})
+
+	return result, err
+}
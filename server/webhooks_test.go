@@ -0,0 +1,222 @@
+package main
+
+import (
+	api "github.com/ksukhorukov/atlant/api"
+
+	"github.com/stretchr/testify/require"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookFromApi(t *testing.T) {
+	webhook, err := WebhookFromApi(&api.Webhook{Url: "https://hooks.example.com/prices", Secret: "s3cret"})
+
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", webhook.Secret)
+
+	for _, webhook_url := range []string{"", "ftp://hooks.example.com/prices", "https:///prices"} {
+		_, err = WebhookFromApi(&api.Webhook{Url: webhook_url})
+
+		require.ErrorContains(t, err, ERROR_WEBHOOK_URL, webhook_url)
+	}
+
+	// webhooks must not reach internal hosts
+	defer func(policy *URLPolicy) { url_policy = policy }(url_policy)
+
+	url_policy = MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", DEFAULT_BLOCKED_NETWORKS)
+
+	_, err = WebhookFromApi(&api.Webhook{Url: "http://169.254.169.254/latest"})
+
+	require.ErrorContains(t, err, ERROR_FORBIDDEN_ADDRESS)
+}
+
+func TestWebhookBatches(t *testing.T) {
+	changes := make([]PriceChange, 5)
+
+	batches := WebhookBatches(changes, 2)
+
+	require.Len(t, batches, 3)
+	require.Len(t, batches[0], 2)
+	require.Len(t, batches[2], 1)
+
+	require.Len(t, WebhookBatches(changes, 5), 1)
+	require.Len(t, WebhookBatches(nil, 5), 0)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	require.Equal(t, DEFAULT_WEBHOOK_BACKOFF, WebhookBackoff(1))
+	require.Equal(t, 4*DEFAULT_WEBHOOK_BACKOFF, WebhookBackoff(3))
+	require.Equal(t, MAX_WEBHOOK_BACKOFF, WebhookBackoff(30))
+}
+
+func TestNewWebhookSlots(t *testing.T) {
+	require.Equal(t, DEFAULT_WEBHOOK_WORKERS, cap(NewWebhookSlots(DEFAULT_WEBHOOK_WORKERS)))
+	require.Equal(t, 1, cap(NewWebhookSlots(0)))
+}
+
+func TestSendWebhook(t *testing.T) {
+	var received *http.Request
+	var body []byte
+
+	response_status := http.StatusNoContent
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/prices", http.StatusFound)
+			return
+		}
+
+		w.WriteHeader(response_status)
+	}))
+
+	defer ts.Close()
+
+	client := NewWebhookClient(url_policy)
+
+	webhook := Webhook{Id: primitive.NewObjectID(), Url: ts.URL + "/prices", Secret: "s3cret"}
+	delivery := WebhookDelivery{Id: primitive.NewObjectID(), WebhookId: webhook.Id, Payload: []byte(`{"import_id":"a"}`)}
+
+	now := time.Unix(1700000000, 0)
+
+	require.NoError(t, SendWebhook(context.Background(), client, webhook, delivery, now))
+
+	require.Equal(t, http.MethodPost, received.Method)
+	require.Equal(t, "application/json", received.Header.Get("Content-Type"))
+	require.Equal(t, delivery.Id.Hex(), received.Header.Get(WEBHOOK_DELIVERY_HEADER))
+	require.Equal(t, strconv.FormatInt(now.Unix(), 10), received.Header.Get(WEBHOOK_TIMESTAMP_HEADER))
+	require.Equal(t, delivery.Payload, body)
+
+	// sha256 HMAC of "1700000000.{"import_id":"a"}" keyed with s3cret
+	require.Equal(t, WebhookSignature("s3cret", now.Unix(), body), received.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+	require.Equal(t, "sha256=a7b44c37fafe05e882886ca0c34c7c93cf9ec1c3467272a2c703846373ee2615", WebhookSignature("s3cret", now.Unix(), body))
+
+	response_status = http.StatusServiceUnavailable
+
+	var status_error *StatusError
+
+	require.True(t, errors.As(SendWebhook(context.Background(), client, webhook, delivery, now), &status_error))
+	require.Equal(t, http.StatusServiceUnavailable, status_error.StatusCode)
+
+	// redirects are not followed
+	webhook.Url = ts.URL + "/moved"
+
+	require.True(t, errors.As(SendWebhook(context.Background(), client, webhook, delivery, now), &status_error))
+	require.Equal(t, http.StatusFound, status_error.StatusCode)
+
+	// the policy is checked on the address connected to
+	webhook.Url = ts.URL + "/prices"
+
+	blocking := NewWebhookClient(MustURLPolicy(DEFAULT_ALLOWED_SCHEMES, "", "", DEFAULT_BLOCKED_NETWORKS))
+
+	err := SendWebhook(context.Background(), blocking, webhook, delivery, now)
+
+	require.ErrorContains(t, err, ERROR_FORBIDDEN_ADDRESS)
+}
+
+func TestQueueAndRecordWebhookDeliveries(t *testing.T) {
+	mongo_address = "127.0.0.1"
+
+	mng_context, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, collection := InitMongo(mng_context)
+
+	defer client.Disconnect(mng_context)
+
+	webhooks := WebhooksCollection(client, DEFAULT_TENANT)
+	deliveries := WebhookDeliveriesCollection(client, DEFAULT_TENANT)
+	changes := PriceChangesCollection(client, DEFAULT_TENANT)
+
+	webhook := Webhook{Id: primitive.NewObjectID(), Url: "https://hooks.example.com/prices", Secret: "s3cret"}
+	job := ImportJob{Id: primitive.NewObjectID().Hex(), Source: "https://supplier-a.com/products.csv", Time: time.Now().Unix()}
+
+	_, err := webhooks.InsertOne(mng_context, webhook)
+
+	require.NoError(t, err)
+
+	defer webhooks.DeleteOne(mng_context, bson.M{"_id": webhook.Id})
+	defer deliveries.DeleteMany(mng_context, bson.M{"webhookid": webhook.Id})
+	defer changes.DeleteMany(mng_context, bson.M{"importid": job.Id})
+
+	for _, product := range []string{"a", "b", "c"} {
+		require.NoError(t, RecordPriceChange(collection, mng_context, PriceChange{Product: product, NewPrice: 1, Added: true, ImportId: job.Id, Time: time.Now()}))
+	}
+
+	defer func(size int) { webhook_batch_size = size }(webhook_batch_size)
+
+	webhook_batch_size = 2
+
+	now := time.Now()
+
+	count, err := QueueWebhooks(collection.Database(), mng_context, job, now)
+
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	var queued []WebhookDelivery
+
+	cursor, err := deliveries.Find(mng_context, bson.M{"webhookid": webhook.Id})
+
+	require.NoError(t, err)
+	require.NoError(t, cursor.All(mng_context, &queued))
+	require.Len(t, queued, 2)
+
+	var payload api.WebhookPayload
+
+	require.NoError(t, protojson.Unmarshal(queued[0].Payload, &payload))
+	require.Equal(t, queued[0].Id.Hex(), payload.GetDeliveryId())
+	require.Equal(t, job.Id, payload.GetImportId())
+	require.Equal(t, int32(2), payload.GetBatches())
+
+	delivery := queued[0]
+
+	claimed, err := ClaimDelivery(deliveries, mng_context, delivery, now)
+
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	// another instance loses the race
+	claimed, err = ClaimDelivery(deliveries, mng_context, delivery, now)
+
+	require.NoError(t, err)
+	require.False(t, claimed)
+
+	delivery.Attempts = int32(webhook_retries)
+
+	result, err := RecordDelivery(deliveries, webhooks, mng_context, delivery, errors.New("connection refused"), now)
+
+	require.NoError(t, err)
+	require.Equal(t, RESULT_DEAD, result)
+
+	response, err := (&server{}).ListDeadLetters(mng_context, &api.ListDeadLettersRequest{WebhookId: webhook.Id.Hex()})
+
+	require.NoError(t, err)
+	require.Len(t, response.GetDeadLetters(), 1)
+	require.Equal(t, "connection refused", response.GetDeadLetters()[0].GetLastError())
+
+	result, err = RecordDelivery(deliveries, webhooks, mng_context, queued[1], nil, now)
+
+	require.NoError(t, err)
+	require.Equal(t, RESULT_DELIVERED, result)
+
+	remaining, err := deliveries.CountDocuments(mng_context, bson.M{"webhookid": webhook.Id})
+
+	require.NoError(t, err)
+	require.Equal(t, int64(1), remaining)
+}